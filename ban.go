@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BanConfig controls who the server's control endpoint refuses to talk to.
+// A strike is a request outside /v1/ that the decoy answers with a status of
+// 400 or more, failed negotiation requests are not. An ip with strikes
+// strikes within strikeWindow seconds is banned for duration seconds,
+// forever if duration is negative. Deny lists ips and cidrs that are always
+// banned, allow ones that never are, such as the negotiator's, and peers
+// with a verified client certificate are never banned or struck either.
+// Bans are saved to stateFile. With
+// adminListenAddress and adminToken set bans can be listed and changed
+// over http:
+//
+//	GET    /v1/bans                 -> [Ban]
+//	POST   /v1/bans                 ban {"prefix", "reason", "duration"}, forever without a duration
+//	DELETE /v1/bans?prefix=<cidr>   unban
+type BanConfig struct {
+	Strikes            int      `json:"strikes"`
+	StrikeWindow       int      `json:"strikeWindow"`
+	Duration           int      `json:"duration"`
+	Allow              []string `json:"allow"`
+	Deny               []string `json:"deny"`
+	StateFile          string   `json:"stateFile"`
+	AdminListenAddress string   `json:"adminListenAddress"`
+	AdminToken         string   `json:"adminToken"`
+}
+
+type Ban struct {
+	Prefix  string    `json:"prefix"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"` // zero for bans that never expire
+
+	network *net.IPNet
+	static  bool // from deny, so not saved
+}
+
+func (b *Ban) Expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+type BanManager struct {
+	Config  BanConfig
+	Bans    map[string]*Ban
+	Strikes map[string][]time.Time
+	Allow   []*net.IPNet
+	mu      sync.Mutex
+}
+
+func NewBanManager(c *BanConfig) *BanManager {
+	b := &BanManager{Bans: make(map[string]*Ban), Strikes: make(map[string][]time.Time)}
+	if c != nil {
+		b.Config = *c
+	}
+	if b.Config.Strikes == 0 {
+		b.Config.Strikes = 3
+	}
+	if b.Config.StrikeWindow == 0 {
+		b.Config.StrikeWindow = 600
+	}
+	if b.Config.Duration == 0 {
+		b.Config.Duration = 3600
+	}
+	if b.Config.StateFile == "" {
+		b.Config.StateFile = "bans.json"
+	}
+	for _, prefix := range append([]string{"127.0.0.0/8", "::1"}, b.Config.Allow...) {
+		network, err := parsePrefix(prefix)
+		if err != nil {
+			log.Panicf("Invalid allowed ip %s\n", prefix)
+		}
+		b.Allow = append(b.Allow, network)
+	}
+
+	if bytes, err := os.ReadFile(b.Config.StateFile); err == nil {
+		var bans []*Ban
+		if err = json.Unmarshal(bytes, &bans); err != nil {
+			log.Printf("Ignoring invalid bans in %s\n%s\n", b.Config.StateFile, err)
+		}
+		now := time.Now()
+		for _, ban := range bans {
+			if ban.network, err = parsePrefix(ban.Prefix); err == nil && !ban.Expired(now) {
+				b.Bans[ban.network.String()] = ban
+			}
+		}
+	}
+	for _, prefix := range b.Config.Deny {
+		network, err := parsePrefix(prefix)
+		if err != nil {
+			log.Panicf("Invalid denied ip %s\n", prefix)
+		}
+		b.Bans[network.String()] = &Ban{Prefix: network.String(), Reason: "denied in config", Created: time.Now(), network: network, static: true}
+	}
+	return b
+}
+
+// parsePrefix parses an ip or cidr into a network.
+func parsePrefix(prefix string) (*net.IPNet, error) {
+	if !strings.Contains(prefix, "/") {
+		ip := net.ParseIP(prefix)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: prefix}
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(prefix)
+	return network, err
+}
+
+func (b *BanManager) IsAllowed(ip net.IP) bool {
+	for _, network := range b.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *BanManager) IsBanned(ipString string) bool {
+	ip := net.ParseIP(ipString)
+	if ip == nil || b.IsAllowed(ip) {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for _, ban := range b.Bans {
+		if !ban.Expired(now) && ban.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Strike records a failed attempt by ip and bans it once it has failed too
+// often.
+func (b *BanManager) Strike(ipString, reason string) {
+	ip := net.ParseIP(ipString)
+	if ip == nil || b.IsAllowed(ip) {
+		return
+	}
+	b.mu.Lock()
+	now := time.Now()
+	window := now.Add(-time.Second * time.Duration(b.Config.StrikeWindow))
+	strikes := []time.Time{now}
+	for _, t := range b.Strikes[ip.String()] {
+		if t.After(window) {
+			strikes = append(strikes, t)
+		}
+	}
+	b.Strikes[ip.String()] = strikes
+	b.mu.Unlock()
+	log.Printf("Strike %d of %d for %s: %s\n", len(strikes), b.Config.Strikes, ip, reason)
+	if len(strikes) >= b.Config.Strikes {
+		b.Ban(ip.String(), b.Config.Duration, reason)
+	}
+}
+
+// Ban bans prefix for duration seconds, or forever if duration is negative.
+func (b *BanManager) Ban(prefix string, duration int, reason string) error {
+	network, err := parsePrefix(prefix)
+	if err != nil {
+		return err
+	}
+	ban := &Ban{Prefix: network.String(), Reason: reason, Created: time.Now(), network: network}
+	if duration >= 0 {
+		ban.Expires = ban.Created.Add(time.Second * time.Duration(duration))
+	}
+	b.mu.Lock()
+	b.Bans[ban.Prefix] = ban
+	if ones, bits := network.Mask.Size(); ones == bits {
+		delete(b.Strikes, network.IP.String())
+	}
+	b.mu.Unlock()
+	log.Printf("Banned %s: %s\n", ban.Prefix, reason)
+	b.Save()
+	return nil
+}
+
+func (b *BanManager) Unban(prefix string) bool {
+	network, err := parsePrefix(prefix)
+	if err != nil {
+		return false
+	}
+	b.mu.Lock()
+	_, ok := b.Bans[network.String()]
+	delete(b.Bans, network.String())
+	b.mu.Unlock()
+	if ok {
+		log.Printf("Unbanned %s\n", network)
+		b.Save()
+	}
+	return ok
+}
+
+// List returns the bans in effect, oldest first.
+func (b *BanManager) List() []*Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bans := []*Ban{}
+	now := time.Now()
+	for _, ban := range b.Bans {
+		if !ban.Expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Created.Before(bans[j].Created)
+	})
+	return bans
+}
+
+// Expire forgets expired bans and old strikes every minute.
+func (b *BanManager) Expire() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		b.mu.Lock()
+		now := time.Now()
+		expired := false
+		for prefix, ban := range b.Bans {
+			if ban.Expired(now) {
+				delete(b.Bans, prefix)
+				expired = true
+			}
+		}
+		window := now.Add(-time.Second * time.Duration(b.Config.StrikeWindow))
+		for ip, strikes := range b.Strikes {
+			if strikes[0].Before(window) {
+				delete(b.Strikes, ip)
+			}
+		}
+		b.mu.Unlock()
+		if expired {
+			b.Save()
+		}
+	}
+}
+
+func (b *BanManager) Save() {
+	bans := []*Ban{}
+	for _, ban := range b.List() {
+		if !ban.static {
+			bans = append(bans, ban)
+		}
+	}
+	bytes, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return
+	}
+	if err = os.WriteFile(b.Config.StateFile, bytes, 0644); err != nil {
+		log.Printf("Failed to save bans to %s\n%s\n", b.Config.StateFile, err)
+	}
+}
+
+func (b *BanManager) ListenForAdmin() {
+	if b.Config.AdminToken == "" {
+		log.Panicln("adminToken is required for the ban admin api")
+	}
+	log.Printf("Listening on %s for ban admin requests\n", b.Config.AdminListenAddress)
+	log.Panic(http.ListenAndServe(b.Config.AdminListenAddress, http.HandlerFunc(b.ServeAdmin)))
+}
+
+func (b *BanManager) ServeAdmin(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(b.Config.AdminToken)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/v1/bans" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(b.List())
+	case http.MethodPost:
+		var ban struct {
+			Prefix   string `json:"prefix"`
+			Reason   string `json:"reason"`
+			Duration int    `json:"duration"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&ban); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if ban.Duration <= 0 {
+			ban.Duration = -1
+		}
+		if err := b.Ban(ban.Prefix, ban.Duration, ban.Reason); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		if !b.Unban(r.URL.Query().Get("prefix")) {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestBanManager(t *testing.T, c BanConfig) *BanManager {
+	t.Helper()
+	if c.StateFile == "" {
+		c.StateFile = filepath.Join(t.TempDir(), "bans.json")
+	}
+	return NewBanManager(&c)
+}
+
+func TestBanManager(t *testing.T) {
+	b := newTestBanManager(t, BanConfig{Strikes: 2, Allow: []string{"192.0.2.0/24"}, Deny: []string{"198.51.100.0/24"}})
+	b.Strike("203.0.113.1", "probe")
+	if b.IsBanned("203.0.113.1") {
+		t.Error("banned after one of two strikes")
+	}
+	b.Strike("203.0.113.1", "probe")
+	b.Strike("192.0.2.1", "probe")
+	b.Strike("192.0.2.1", "probe")
+	b.Strike("127.0.0.1", "probe")
+	b.Strike("127.0.0.1", "probe")
+	if err := b.Ban("2001:db8::/32", -1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Ban("203.0.113.2", 0, "expired"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip     string
+		banned bool
+	}{
+		{"203.0.113.1", true},
+		{"203.0.113.3", false},
+		{"192.0.2.1", false},
+		{"127.0.0.1", false},
+		{"198.51.100.7", true},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"203.0.113.2", false},
+		{"not an ip", false},
+	}
+	for _, test := range tests {
+		if banned := b.IsBanned(test.ip); banned != test.banned {
+			t.Errorf("IsBanned(%s) = %t, want %t", test.ip, banned, test.banned)
+		}
+	}
+
+	if !b.Unban("2001:db8::/32") || b.IsBanned("2001:db8::1") {
+		t.Error("unbanning 2001:db8::/32 failed")
+	}
+}
+
+func TestBansAreSaved(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "bans.json")
+	b := newTestBanManager(t, BanConfig{StateFile: stateFile, Deny: []string{"198.51.100.0/24"}})
+	b.Ban("203.0.113.1", -1, "test")
+
+	loaded := newTestBanManager(t, BanConfig{StateFile: stateFile})
+	if !loaded.IsBanned("203.0.113.1") {
+		t.Error("ban was not loaded from the state file")
+	}
+	if loaded.IsBanned("198.51.100.1") {
+		t.Error("ban from deny was saved to the state file")
+	}
+}
+
+func TestControlStrikes(t *testing.T) {
+	s := &Server{Decoy: http.NotFoundHandler(), Bans: newTestBanManager(t, BanConfig{Strikes: 1})}
+	tests := []struct {
+		name    string
+		path    string
+		trusted bool
+		banned  bool
+	}{
+		{"probe", "/admin", false, true},
+		{"session api", "/v1/sessions", false, false},
+		{"unknown session api route", "/v1/other", false, false},
+		{"probe from a client certificate", "/admin", true, false},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader("{}"))
+		r.RemoteAddr = fmt.Sprintf("203.0.113.%d:1234", i+1)
+		if test.trusted {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}
+		}
+		s.ServeControl(httptest.NewRecorder(), r)
+		if banned := s.Bans.IsBanned(getIPFromAddress(r.RemoteAddr)); banned != test.banned {
+			t.Errorf("%s: banned = %t, want %t", test.name, banned, test.banned)
+		}
+	}
+}
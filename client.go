@@ -1,14 +1,18 @@
 package main
 
 import (
+	"crypto/ecdh"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
 type Client struct {
+	ServerIP                            string
 	ServerPort                          string
 	Port                                string
 	ServiceAddresses                    map[byte]*net.UDPAddr
@@ -18,74 +22,192 @@ type Client struct {
 	ConnectionToServer                  *net.UDPConn
 	PacketIDToServiceListenerTable      map[byte]*net.UDPConn
 	LastReceivedPacketFromServer        int64
-	IsListeningForPacketsFromServer     bool
 	IsFirstTry                          bool
 	ReconnectAttemps                    int
 	LastCommunicatedPacketsWithServices map[byte]int64
+	PacketIDToUDPHeader                 map[byte][]byte
+	FlowMutex                           sync.Mutex // guards the udp flow maps above
+	TCPServiceListeners                 []*net.TCPListener
+	Streams                             *StreamTable
+	Tun                                 *Tun
+	ReverseConnections                  map[byte]*net.UDPConn
+	ReverseMutex                        sync.Mutex // guards ReverseConnections
+	Signaling                           Signaling
+	ServerPublicKey                     *ecdh.PublicKey
+	Token                               []byte
+	SessionKey                          []byte
+	Ticket                              []byte
+	Buffer                              PacketBuffer
 }
 
-func (c *Client) AssignPacketID() byte {
+// AssignPacketID returns an id that no udp flow or stream uses, or false if
+// all of them are taken. It must be called with c.FlowMutex held.
+func (c *Client) AssignPacketID() (byte, bool) {
 	for remoteAddress, id := range c.ServiceIDs {
 		diff := time.Now().Unix() - c.LastCommunicatedPacketsWithServices[id]
 		if c.Ready && diff > int64(config.SerivceTimeout) {
 			log.Printf("Did not communicate any packet with %s for %d seconds, closing connection\n", remoteAddress, diff)
-			c.ConnectionToServer.Write([]byte{6, byte(id)})
-			delete(c.LastCommunicatedPacketsWithServices, id)
-			delete(c.ServiceIDs, remoteAddress)
-			delete(c.PacketIDToServiceListenerTable, id)
+			c.freeUDPFlow(remoteAddress)
 		}
 	}
-	var id int = 0
-	for ; id < 256; id++ {
-		if _, ok := c.PacketIDToServiceListenerTable[byte(id)]; !ok {
-			break
+	for id := 0; id < firstReverseID; id++ {
+		if _, ok := c.PacketIDToServiceListenerTable[byte(id)]; !ok && !c.Streams.Has(byte(id)) {
+			return byte(id), true
 		}
 	}
-	return byte(id)
+	return 0, false
+}
+
+var errNoFreeID = errors.New("no free id")
+
+// OpenStream opens a stream for conn to destination on a free id, see
+// StreamTable.Open, and returns errNoFreeID if there is none. If the open
+// cannot be sent the stream is reset, which closes conn and tells opened.
+func (c *Client) OpenStream(conn net.Conn, destination []byte, opened func(reason byte)) (byte, error) {
+	c.FlowMutex.Lock()
+	defer c.FlowMutex.Unlock()
+	id, ok := c.AssignPacketID()
+	if !ok {
+		return 0, errNoFreeID
+	}
+	return id, c.Streams.Open(id, conn, destination, opened)
 }
 
-func (c *Client) NegotiatePorts() {
-	res, err := httpClient.Head(config.Negotiator)
+// AssignUDPFlow returns the id used for packets identified by key, which are
+// answered through listener to remoteAddress with header in front of them,
+// or false if no id is free. New flows are announced to the server with
+// their destination before any packet is sent.
+func (c *Client) AssignUDPFlow(key string, listener *net.UDPConn, remoteAddress *net.UDPAddr, announcement, header []byte) (byte, bool) {
+	c.FlowMutex.Lock()
+	defer c.FlowMutex.Unlock()
+	if id, ok := c.ServiceIDs[key]; ok {
+		c.LastCommunicatedPacketsWithServices[id] = time.Now().Unix()
+		return id, true
+	}
+	id, ok := c.AssignPacketID()
+	if !ok {
+		log.Printf("No free id for packets from %s, dropping them\n", key)
+		return 0, false
+	}
+	c.LastCommunicatedPacketsWithServices[id] = time.Now().Unix()
+	c.ServiceIDs[key] = id
+	c.ServiceAddresses[id] = remoteAddress
+	c.PacketIDToServiceListenerTable[id] = listener
+	if len(header) > 0 {
+		c.PacketIDToUDPHeader[id] = append([]byte{}, header...)
+	}
+	log.Printf("Received packet from new user at %s on %s with id of %d\n", key, listener.LocalAddr().String(), id)
+	announcementPacket := []byte{4, id}
+	announcementPacket = append(announcementPacket, announcement...)
+	err := c.Send(announcementPacket)
 	if err != nil {
 		log.Panicln(err)
 	}
-	if res.StatusCode != 200 {
-		log.Panicf("%s did not respond to HEAD request with status 200\n", config.Negotiator)
+	log.Printf("Sent destination announcement packet to server\n")
+	return id, true
+}
+
+// FreeUDPFlow forgets the flow identified by key and tells the server to do
+// the same.
+func (c *Client) FreeUDPFlow(key string) {
+	c.FlowMutex.Lock()
+	defer c.FlowMutex.Unlock()
+	c.freeUDPFlow(key)
+}
+
+// FreeUDPFlowID forgets the flow with id after the server closed it, so the
+// next packet from the same user starts a new one.
+func (c *Client) FreeUDPFlowID(id byte) {
+	c.FlowMutex.Lock()
+	defer c.FlowMutex.Unlock()
+	for key, i := range c.ServiceIDs {
+		if i == id {
+			log.Printf("Server closed the flow of %s with id %d\n", key, id)
+			c.freeUDPFlow(key)
+		}
+	}
+}
+
+// freeUDPFlow must be called with c.FlowMutex held.
+func (c *Client) freeUDPFlow(key string) {
+	id, ok := c.ServiceIDs[key]
+	if !ok {
+		return
 	}
+	if c.Ready {
+		c.ConnectionToServer.Write([]byte{6, id})
+	}
+	delete(c.LastCommunicatedPacketsWithServices, id)
+	delete(c.ServiceIDs, key)
+	delete(c.ServiceAddresses, id)
+	delete(c.PacketIDToServiceListenerTable, id)
+	delete(c.PacketIDToUDPHeader, id)
+}
 
-	listenAddress := resolveAddress("0.0.0.0:0")
-	tempConn, err := net.ListenUDP("udp4", listenAddress)
+// Negotiate sends request to the server at serverIP and returns its
+// response, panicking if the server refused it.
+func (c *Client) Negotiate(serverIP string, request *NegotiationRequest) *NegotiationResponse {
+	request.Timestamp = uint32(time.Now().Unix())
+	clientIP, err := c.Signaling.ClientIP(serverIP)
 	if err != nil {
 		log.Panicln(err)
 	}
-	c.Port = getPortFromAddress(tempConn.LocalAddr().String())
-	tempConn.Close()
-	log.Printf("Selected port %s as listening port for tunnel\n", c.Port)
-	res, err = httpClient.Get(fmt.Sprintf("%s/%s/%s", config.Negotiator, config.ServerIP, c.Port)) // https://negotiator/serverIP/ClientIPAndPort
+	request.ClientIP = net.ParseIP(clientIP)
+	message, aead, err := SealNegotiationRequest(request, c.ServerPublicKey)
 	if err != nil {
 		log.Panicln(err)
 	}
-	if res.StatusCode != 200 {
-		log.Panicf("GET %s/%s/%s failed with status %d\n", config.Negotiator, config.ServerIP, c.Port, res.StatusCode)
+	answer, err := c.Signaling.Exchange(serverIP, message)
+	if err != nil {
+		log.Panicln(err)
 	}
-	portBytes, err := io.ReadAll(res.Body)
+	response, err := OpenNegotiationResponse(answer, aead)
+	if err != nil {
+		log.Panicf("Invalid negotiation response from %s: %s\n", serverIP, err)
+	}
+	if response.Status != 200 {
+		log.Panicf("Negotiation request %d to %s failed with status %d\n", request.Method, serverIP, response.Status)
+	}
+	return response
+}
+
+// SelectPort returns a free local port for a tunnel to serverIP.
+func (c *Client) SelectPort(serverIP string) string {
+	tempConn, err := net.ListenUDP(udpNetwork(serverIP), &net.UDPAddr{})
 	if err != nil {
 		log.Panicln(err)
 	}
-	res.Body.Close()
-	c.ServerPort = string(portBytes)
-	log.Printf("Negotiated server port: %s\n", portBytes)
+	port := getPortFromAddress(tempConn.LocalAddr().String())
+	tempConn.Close()
+	log.Printf("Selected port %s as listening port for tunnel to %s\n", port, serverIP)
+	return port
+}
+
+func (c *Client) NegotiatePorts(serverIP string, token []byte) (string, string, []byte) {
+	port := c.SelectPort(serverIP)
+	key := randomBytes(negotiationKeyLength)
+	response := c.Negotiate(serverIP, &NegotiationRequest{Version: negotiationVersion, Method: negotiateAllocate, ClientPort: portNumber(port), Token: token, Capabilities: localCapabilities(), Key: key})
+	missing := localCapabilities() &^ response.Capabilities
+	if missing&capabilityReverse != 0 {
+		log.Printf("Server at %s does not accept reverse services\n", serverIP)
+	}
+	if missing&capabilityTun != 0 {
+		log.Printf("Server at %s does not have tun mode enabled\n", serverIP)
+	}
+	serverPort := strconv.Itoa(int(response.ServerPort))
+	log.Printf("Negotiated server port: %s\n", serverPort)
+	return port, serverPort, sessionKey(key, response.Key)
 }
 
-func (c *Client) OpenPortAndSendDummyPacket() {
-	listenAddress := resolveAddress("0.0.0.0:" + c.Port)
-	remoteAddress := resolveAddress(config.ServerIP + ":" + c.ServerPort)
-	conn, err := net.DialUDP("udp4", listenAddress, remoteAddress)
+func (c *Client) OpenPortAndSendDummyPacket(serverIP, port, serverPort string, key []byte) {
+	listenAddress := resolveAddress(net.JoinHostPort("", port))
+	remoteAddress := resolveAddress(net.JoinHostPort(serverIP, serverPort))
+	conn, err := net.DialUDP(udpNetwork(serverIP), listenAddress, remoteAddress)
 	if err != nil {
 		log.Panicln(err)
 	}
 	log.Printf("Opened port from %s to %s\n", conn.LocalAddr().String(), remoteAddress.String())
-	_, err = conn.Write([]byte{1, 0}) // dummy packet
+	_, err = conn.Write(TimestampedPacket(1, key, fromClient))
 	if err != nil {
 		log.Panicln(err)
 	}
@@ -93,22 +215,169 @@ func (c *Client) OpenPortAndSendDummyPacket() {
 	conn.Close()
 }
 
-func (c *Client) AskServerToSendDummyPacket() {
-	for !c.IsListeningForPacketsFromServer {
-		time.Sleep(time.Millisecond * 10)
-	}
+func (c *Client) AskServerToSendDummyPacket(serverIP, port string, token []byte) {
 	log.Printf("Asking server for dummy packet\n")
-	res, err := httpClient.Post(fmt.Sprintf("%s/%s/%s", config.Negotiator, config.ServerIP, c.Port), "text/plain", nil) // https://negotiator/serverIP/ClientIPAndPort
+	c.Negotiate(serverIP, &NegotiationRequest{Version: negotiationVersion, Method: negotiatePunch, ClientPort: portNumber(port), Token: token, Key: make([]byte, negotiationKeyLength)})
+}
+
+// TearDown tells the server to forget the tunnel to port, so it does not
+// wait for the keep-alive timeout after the client has moved on.
+func (c *Client) TearDown(serverIP, port string, token []byte) {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("Failed to tear down tunnel to %s from port %s\n%v\n", serverIP, port, e)
+		}
+	}()
+	c.Negotiate(serverIP, &NegotiationRequest{Version: negotiationVersion, Method: negotiateTearDown, ClientPort: portNumber(port), Token: token, Key: make([]byte, negotiationKeyLength)})
+}
+
+// handshake is a tunnel negotiated with one of the server's addresses.
+type handshake struct {
+	serverIP   string
+	conn       *net.UDPConn
+	token      []byte
+	sessionKey []byte
+	err        interface{}
+}
+
+// Handshake negotiates a tunnel with the server at serverIP and returns it
+// once the server's dummy packet has been received.
+func (c *Client) Handshake(serverIP string) handshake {
+	token := randomBytes(16)
+	port, serverPort, key := c.NegotiatePorts(serverIP, token)
+	conn := c.Punch(serverIP, port, serverPort, token, key)
+	return handshake{serverIP: serverIP, conn: conn, token: token, sessionKey: key}
+}
+
+// Punch opens port towards the server's port and returns the connection
+// once dummy packets have come through it both ways.
+func (c *Client) Punch(serverIP, port, serverPort string, token, key []byte) *net.UDPConn {
+	c.OpenPortAndSendDummyPacket(serverIP, port, serverPort, key)
+
+	remoteAddress := resolveAddress(net.JoinHostPort(serverIP, serverPort))
+	tunnelListenAddress := resolveAddress(net.JoinHostPort("", port))
+	conn, err := net.DialUDP(udpNetwork(serverIP), tunnelListenAddress, remoteAddress)
 	if err != nil {
 		log.Panicln(err)
 	}
-	if res.StatusCode != 200 {
-		log.Panicf("POST %s/%s/%s failed with status %d\n", config.Negotiator, config.ServerIP, c.Port, res.StatusCode)
+	log.Printf("Listening on %s for dummy packet from %s\n", tunnelListenAddress.String(), remoteAddress.String())
+
+	c.AskServerToSendDummyPacket(serverIP, port, token)
+
+	if err := ConfirmPunch(conn, key); err != nil {
+		conn.Close()
+		go c.TearDown(serverIP, port, token)
+		log.Panicln(err)
+	}
+	log.Printf("Received dummy packet from server at %s\n", remoteAddress.String())
+	return conn
+}
+
+// ConfirmPunch waits for the server's dummy packet on conn and answers it
+// with dummy packets until the server has answered one of them, so the
+// session becomes ready on the server even if the dummy packet sent before
+// the punch was lost.
+func ConfirmPunch(conn *net.UDPConn, key []byte) error {
+	deadline := time.Now().Add(handshakeTimeout)
+	buffer := make([]byte, 1024*8)
+	conn.SetReadDeadline(deadline)
+	var last int64
+	for last == 0 {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return err
+		}
+		last, _ = VerifyTimestampedPacket(buffer[:n], 1, key, fromServer, 0)
+	}
+	for {
+		if _, err := conn.Write(TimestampedPacket(1, key, fromClient)); err != nil {
+			return err
+		}
+		resend := time.Now().Add(dummyPacketInterval)
+		if resend.After(deadline) {
+			resend = deadline
+		}
+		conn.SetReadDeadline(resend)
+		for {
+			n, err := conn.Read(buffer)
+			if err, ok := err.(net.Error); ok && err.Timeout() && time.Now().Before(deadline) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if _, ok := VerifyTimestampedPacket(buffer[:n], 1, key, fromServer, last); ok {
+				conn.SetReadDeadline(time.Time{})
+				return nil
+			}
+		}
+	}
+}
+
+// Connect runs handshakes with every address of the server, happy eyeballs
+// style: addresses are tried in order with a short delay between them and
+// the first tunnel that becomes ready wins. The others are closed.
+func (c *Client) Connect() {
+	serverIPs := resolveServerIPs(config.ServerIP)
+	results := make(chan handshake, len(serverIPs))
+	connected := make(chan struct{})
+	for i, serverIP := range serverIPs {
+		go func(i int, serverIP string) {
+			select {
+			case <-connected:
+				results <- handshake{serverIP: serverIP, err: "skipped"}
+				return
+			case <-time.After(happyEyeballsDelay * time.Duration(i)):
+			}
+			defer func() {
+				if e := recover(); e != nil {
+					results <- handshake{serverIP: serverIP, err: e}
+				}
+			}()
+			results <- c.Handshake(serverIP)
+		}(i, serverIP)
+	}
+
+	for i := range serverIPs {
+		result := <-results
+		if result.conn == nil {
+			log.Printf("Handshake with %s failed: %v\n", result.serverIP, result.err)
+			continue
+		}
+		close(connected)
+		go func(remaining int) {
+			for ; remaining > 0; remaining-- {
+				if r := <-results; r.conn != nil {
+					r.conn.Write([]byte{3, 0})
+					r.conn.Close()
+					c.TearDown(r.serverIP, getPortFromAddress(r.conn.LocalAddr().String()), r.token)
+				}
+			}
+		}(len(serverIPs) - i - 1)
+
+		if c.ConnectionToServer != nil {
+			c.ConnectionToServer.Close()
+		}
+		c.ConnectionToServer = result.conn
+		c.ServerIP = result.serverIP
+		c.Port = getPortFromAddress(result.conn.LocalAddr().String())
+		c.ServerPort = getPortFromAddress(result.conn.RemoteAddr().String())
+		c.Token = result.token
+		c.SessionKey = result.sessionKey
+		c.Ticket = sessionTicket(result.sessionKey)
+		return
 	}
+	log.Panicf("Failed to connect to %s\n", config.ServerIP)
 }
 
 func (c *Client) Start() {
 	c.IsFirstTry = true
+	c.Signaling = NewSignaling()
+	serverPublicKey, err := ParsePublicKey(config.ServerPublicKey)
+	if err != nil {
+		log.Panicf("Invalid serverPublicKey %q\n", config.ServerPublicKey)
+	}
+	c.ServerPublicKey = serverPublicKey
 	for {
 		func() {
 			defer func() {
@@ -117,53 +386,76 @@ func (c *Client) Start() {
 				}
 			}()
 
-			c.IsListeningForPacketsFromServer = false
 			c.Ready = false
 
-			c.NegotiatePorts()
-			c.OpenPortAndSendDummyPacket()
+			// a session that can be resumed keeps its flows and streams
+			resumed := !c.IsFirstTry && c.Resume()
+			if !resumed {
+				if c.IsFirstTry {
+					c.Streams = newStreamTable(c.Send, c.DialReverseService)
+					c.ReverseMutex.Lock()
+					c.ReverseConnections = make(map[byte]*net.UDPConn)
+					c.ReverseMutex.Unlock()
+				} else {
+					c.Streams.CloseAll()
+					c.CloseReverseUDPFlows()
+				}
 
-			c.LastCommunicatedPacketsWithServices = make(map[byte]int64)
-			c.ServiceAddresses = make(map[byte]*net.UDPAddr)
-			c.ServiceIDs = make(map[string]byte)
-			if c.IsFirstTry {
-				c.PacketIDToServiceListenerTable = make(map[byte]*net.UDPConn)
-			}
+				c.FlowMutex.Lock()
+				c.LastCommunicatedPacketsWithServices = make(map[byte]int64)
+				c.ServiceAddresses = make(map[byte]*net.UDPAddr)
+				c.ServiceIDs = make(map[string]byte)
+				c.PacketIDToUDPHeader = make(map[byte][]byte)
+				if c.IsFirstTry {
+					c.PacketIDToServiceListenerTable = make(map[byte]*net.UDPConn)
+				}
+				c.FlowMutex.Unlock()
+				c.Buffer.Reset()
 
-			remoteAddress := resolveAddress(config.ServerIP + ":" + c.ServerPort)
-			tunnelListenAddress := resolveAddress("0.0.0.0:" + c.Port)
-			var err error
-			c.ConnectionToServer, err = net.DialUDP("udp4", tunnelListenAddress, remoteAddress)
-			if err != nil {
-				log.Panicln(err)
+				if c.ServerIP != "" {
+					go c.TearDown(c.ServerIP, c.Port, c.Token)
+				}
+				c.Connect()
+			}
+			c.LastReceivedPacketFromServer = time.Now().Unix()
+			c.Ready = true
+			c.ReconnectAttemps = 0
+			if n := c.Buffer.Flush(c.Send); n > 0 {
+				log.Printf("Sent %d packets buffered while the tunnel was down\n", n)
 			}
-			log.Printf("Listening on %s for dummy packet from %s\n", tunnelListenAddress.String(), remoteAddress.String())
+			fmt.Println("READY")
+			c.SendReverseServiceRegistrations()
 
-			go func() {
+			go func(connectionToServer *net.UDPConn) {
 				defer func() {
 					if e := recover(); e != nil {
 						log.Println("panic occurred:", e)
 					}
 				}()
+				var err error
 				var packet Packet
 				buffer := make([]byte, 1024*8)
 				var n int
-				c.IsListeningForPacketsFromServer = true
 				for {
-					n, err = c.ConnectionToServer.Read(buffer)
+					n, err = connectionToServer.Read(buffer)
 					if err != nil {
 						log.Panicln(err)
 					}
+					if n < 2 {
+						continue
+					}
 					packet.DecodePacket(buffer[:n])
 
 					c.LastReceivedPacketFromServer = time.Now().Unix()
 
 					// handle flags
 					if packet.Flags == 1 {
-						log.Printf("Received dummy packet from server\n")
-						c.Ready = true
-						c.ReconnectAttemps = 0
-						fmt.Println("READY")
+						continue
+					} else if packet.Flags == 15 {
+						if challenge, ok := VerifySignedPacket(buffer[:n], 15, c.SessionKey, fromServer); ok {
+							log.Printf("Received path challenge from server\n")
+							c.ConnectionToServer.Write(SignedPacket(16, c.SessionKey, fromClient, challenge))
+						}
 						continue
 					} else if packet.Flags == 3 {
 						log.Printf("Received close connection packet from server\n")
@@ -173,35 +465,77 @@ func (c *Client) Start() {
 						if err != nil {
 							log.Panicln(err)
 						}
+						c.SendReverseServiceRegistrations()
+						continue
+					} else if isStreamFlag(packet.Flags) {
+						c.Streams.HandlePacket(&packet)
+						continue
+					} else if packet.Flags == 12 {
+						if c.Tun != nil {
+							c.Tun.File.Write(packet.Payload)
+						}
+						continue
+					} else if packet.Flags == 4 && packet.ID >= firstReverseID {
+						c.OpenReverseUDPFlow(packet.ID, packet.Payload)
+						continue
+					} else if packet.Flags == 6 && packet.ID >= firstReverseID {
+						c.CloseReverseUDPFlow(packet.ID)
+						continue
+					} else if packet.Flags == 6 {
+						c.FreeUDPFlowID(packet.ID)
 						continue
 					}
 
-					_, err = c.PacketIDToServiceListenerTable[packet.ID].WriteTo(packet.Payload, c.ServiceAddresses[packet.ID])
+					if packet.ID >= firstReverseID {
+						c.ReverseMutex.Lock()
+						conn, ok := c.ReverseConnections[packet.ID]
+						c.ReverseMutex.Unlock()
+						if ok {
+							conn.Write(packet.Payload)
+						}
+						continue
+					}
+
+					c.FlowMutex.Lock()
+					listener, ok := c.PacketIDToServiceListenerTable[packet.ID]
+					serviceAddress := c.ServiceAddresses[packet.ID]
+					if header, ok := c.PacketIDToUDPHeader[packet.ID]; ok {
+						packet.Payload = append(append([]byte{}, header...), packet.Payload...)
+					}
+					if ok {
+						c.LastCommunicatedPacketsWithServices[packet.ID] = time.Now().Unix()
+					}
+					c.FlowMutex.Unlock()
+					if !ok {
+						continue
+					}
+					_, err = listener.WriteTo(packet.Payload, serviceAddress)
 					if err != nil {
 						log.Panicln(err)
 					}
-					c.LastCommunicatedPacketsWithServices[packet.ID] = time.Now().Unix()
 				}
-			}()
+			}(c.ConnectionToServer)
+			go c.Roam(c.ConnectionToServer)
 
-			c.AskServerToSendDummyPacket()
-
-			for _, servicePort := range config.ServicePorts {
-				go func(servicePort uint16) {
+			for _, service := range config.Services {
+				if service.Protocol != "udp" {
+					continue
+				}
+				go func(service Service) {
 					defer func() {
 						if e := recover(); e != nil {
 							log.Println("panic occurred:", e)
 						}
 					}()
-					serviceListenAddress := resolveAddress(fmt.Sprintf("0.0.0.0:%d", servicePort))
+					serviceListenAddress := resolveAddress(fmt.Sprintf(":%d", service.Port))
 					var serviceListener *net.UDPConn
 					var err error
 					if c.IsFirstTry {
-						serviceListener, err = net.ListenUDP("udp4", serviceListenAddress)
+						serviceListener, err = net.ListenUDP("udp", serviceListenAddress)
 						c.ServiceListeners = append(c.ServiceListeners, serviceListener)
 					} else {
 						for _, l := range c.ServiceListeners {
-							if l.LocalAddr().String() == serviceListenAddress.String() {
+							if l.LocalAddr().(*net.UDPAddr).Port == serviceListenAddress.Port {
 								serviceListener = l
 								break
 							}
@@ -224,31 +558,36 @@ func (c *Client) Start() {
 						if err != nil {
 							log.Panicln(err)
 						}
-						if id, ok := c.ServiceIDs[serviceRemoteAddress.String()]; ok {
-							packet.ID = id
-							c.LastCommunicatedPacketsWithServices[id] = time.Now().Unix()
-						} else {
-							packet.ID = c.AssignPacketID()
-							c.LastCommunicatedPacketsWithServices[packet.ID] = time.Now().Unix()
-							c.ServiceIDs[serviceRemoteAddress.String()] = packet.ID
-							c.ServiceAddresses[packet.ID] = serviceRemoteAddress
-							c.PacketIDToServiceListenerTable[packet.ID] = serviceListener
-							log.Printf("Received packet from new user at %s on service at %s with id of %d\n", serviceRemoteAddress.String(), serviceListenAddress.String(), packet.ID)
-							announcementPacket := []byte{4, packet.ID}
-							announcementPacket = append(announcementPacket, Uint16ToByteSlice(servicePort)...)
-							_, err := c.ConnectionToServer.Write(announcementPacket)
-							if err != nil {
-								log.Panicln(err)
-							}
-							log.Printf("Sent port announcement packet to server\n")
+						var ok bool
+						packet.ID, ok = c.AssignUDPFlow(serviceRemoteAddress.String(), serviceListener, serviceRemoteAddress, service.Announcement, nil)
+						if !ok {
+							continue
 						}
 						packet.Payload = buffer[:n]
-						_, err = c.ConnectionToServer.Write(packet.EncodePacket())
+						err = c.Send(packet.EncodePacket())
 						if err != nil {
 							log.Panicln(err)
 						}
 					}
-				}(servicePort)
+				}(service)
+			}
+
+			if c.IsFirstTry {
+				for _, service := range config.Services {
+					if service.Protocol == "tcp" {
+						go c.ListenForTCPService(service)
+					}
+				}
+				if config.SOCKSListenAddress != "" {
+					go c.ListenForSOCKS()
+				}
+				if config.HTTPProxyListenAddress != "" {
+					go c.ListenForHTTPProxy()
+				}
+				if config.Tun != nil {
+					c.Tun = OpenTun(config.Tun)
+					go c.ForwardTunPackets()
+				}
 			}
 
 			ticker := time.NewTicker(time.Second * time.Duration(config.KeepAliveInterval[1]))
@@ -272,3 +611,94 @@ func (c *Client) Start() {
 		c.ReconnectAttemps++
 	}
 }
+
+// roamingTimeout is a third of the keep-alive timeout, which leaves time for
+// a few address change packets and the path challenge before the client
+// gives up on the tunnel.
+func roamingTimeout() time.Duration {
+	timeout := time.Second * time.Duration(config.KeepAliveInterval[1]) / 3
+	if timeout < time.Second*2 {
+		return time.Second * 2
+	}
+	return timeout
+}
+
+// Roam sends an address change packet whenever the server has been quiet
+// for roamingTimeout, in case the client's address changed and the server's
+// packets are going to the old one.
+func (c *Client) Roam(conn *net.UDPConn) {
+	timeout := roamingTimeout()
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if conn != c.ConnectionToServer {
+			return
+		}
+		if c.Ready && time.Since(time.Unix(c.LastReceivedPacketFromServer, 0)) >= timeout {
+			log.Printf("Did not hear from server for %s, sending address change packet\n", timeout.Round(time.Second))
+			conn.Write(TimestampedPacket(14, c.SessionKey, fromClient))
+		}
+	}
+}
+
+// ListenForTCPService accepts tcp connections on the service port and carries
+// each of them to the service destination as a stream. The listener outlives
+// reconnects, connections accepted while the tunnel is down are dropped.
+func (c *Client) ListenForTCPService(service Service) {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Println("panic occurred:", e)
+		}
+	}()
+	serviceListenAddress, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", service.Port))
+	if err != nil {
+		log.Panicln(err)
+	}
+	listener, err := net.ListenTCP("tcp", serviceListenAddress)
+	if err != nil {
+		log.Panicln(err)
+	}
+	c.TCPServiceListeners = append(c.TCPServiceListeners, listener)
+	log.Printf("Listening on %s for tcp service connections\n", serviceListenAddress.String())
+
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			log.Panicln(err)
+		}
+		if !c.Ready {
+			log.Printf("Tunnel is not ready, dropping tcp connection from %s\n", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		id, err := c.OpenStream(conn, service.Announcement, nil)
+		if err != nil {
+			log.Printf("Dropping tcp connection from %s\n%s\n", conn.RemoteAddr().String(), err)
+			conn.Close()
+			continue
+		}
+		log.Printf("Accepted tcp connection from %s on service at %s with id of %d\n", conn.RemoteAddr().String(), serviceListenAddress.String(), id)
+	}
+}
+
+// ForwardTunPackets sends ip packets read from the tun interface to the
+// server. Packets read while the tunnel is down are buffered.
+func (c *Client) ForwardTunPackets() {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Println("panic occurred:", e)
+		}
+	}()
+	buffer := make([]byte, 1024*8)
+	buffer[0] = 12
+	for {
+		n, err := c.Tun.File.Read(buffer[2:])
+		if err != nil {
+			log.Panicln(err)
+		}
+		err = c.Send(buffer[:2+n])
+		if err != nil {
+			log.Printf("Error writing ip packet to server\n%s\n", err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestServer() *Server {
+	return &Server{
+		ServerToClientConnections: make(map[string]*User),
+		TunAddressToUser:          make(map[string]*User),
+		SeenNegotiations:          make(map[string]*SeenNegotiation),
+	}
+}
+
+// newTestSession allocates a session on s for a client on 127.0.0.1 and
+// returns the client's connection to it, without punching yet.
+func newTestSession(t *testing.T, s *Server) (conn *net.UDPConn, clientIPAndPort string, token, key []byte) {
+	t.Helper()
+	clientPort := (&Client{}).SelectPort("127.0.0.1")
+	clientIPAndPort = net.JoinHostPort("127.0.0.1", clientPort)
+	token, clientKey := randomBytes(16), randomBytes(negotiationKeyLength)
+	response := s.HandleNegotiation(clientIPAndPort, &NegotiationRequest{Version: negotiationVersion, Method: negotiateAllocate, ClientPort: portNumber(clientPort), Token: token, Key: clientKey})
+	if response.Status != 200 {
+		t.Fatalf("allocate answered with %d", response.Status)
+	}
+	t.Cleanup(func() {
+		s.HandleNegotiation(clientIPAndPort, &NegotiationRequest{Version: negotiationVersion, Method: negotiateTearDown, Token: token})
+	})
+	conn, err := net.DialUDP("udp4", resolveAddress(clientIPAndPort), resolveAddress(net.JoinHostPort("127.0.0.1", strconv.Itoa(int(response.ServerPort)))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, clientIPAndPort, token, sessionKey(clientKey, response.Key)
+}
+
+// punchTestSession asks s to punch to conn and confirms the punch.
+func punchTestSession(t *testing.T, s *Server, conn *net.UDPConn, clientIPAndPort string, token, key []byte) {
+	t.Helper()
+	if response := s.HandleNegotiation(clientIPAndPort, &NegotiationRequest{Version: negotiationVersion, Method: negotiatePunch, Token: token}); response.Status != 200 {
+		t.Fatalf("punch answered with %d", response.Status)
+	}
+	start := time.Now()
+	if err := ConfirmPunch(conn, key); err != nil {
+		t.Fatalf("ConfirmPunch failed after %s: %s", time.Since(start), err)
+	}
+}
+
+func TestConfirmPunchWithoutFirstDummyPacket(t *testing.T) {
+	s := newTestServer()
+	// the dummy packet the client sends before the punch never arrives
+	// and the server only answers the client's dummy packet once it is ready
+	conn, clientIPAndPort, token, key := newTestSession(t, s)
+	punchTestSession(t, s, conn, clientIPAndPort, token, key)
+}
+
+func TestConfirmPunchResendsDummyPackets(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	key := randomBytes(negotiationKeyLength)
+
+	// a server that punches and drops the client's first two dummy packets
+	server.WriteToUDP(TimestampedPacket(1, key, fromServer), conn.LocalAddr().(*net.UDPAddr))
+	go func() {
+		buffer := make([]byte, 1024)
+		for dummies := 0; dummies < 3; {
+			n, from, err := server.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			if _, ok := VerifyTimestampedPacket(buffer[:n], 1, key, fromClient, 0); ok {
+				dummies++
+			}
+			if dummies == 3 {
+				server.WriteToUDP(TimestampedPacket(1, key, fromServer), from)
+			}
+		}
+	}()
+	start := time.Now()
+	if err := ConfirmPunch(conn, key); err != nil {
+		t.Fatalf("ConfirmPunch failed after %s: %s", time.Since(start), err)
+	}
+	if elapsed := time.Since(start); elapsed < dummyPacketInterval*2 {
+		t.Errorf("ConfirmPunch returned after %s, before the third dummy packet was answered", elapsed)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The control endpoint is the http server negotiators relay negotiation
+// messages to. It listens on controlListenAddress (:80 by default), with
+// controlTLS in https using controlCertFile and controlKeyFile, which are
+// created with a self-signed certificate if they do not exist. With
+// controlClientCAFile set only clients with a certificate signed by one of
+// its cas, such as the negotiator, can connect.
+
+// ControlConfig tells the negotiator how to reach the control endpoint of
+// servers. Certificates are checked like a negotiator's, with pins and
+// insecure for self-signed ones, where the pin has to match the server's own
+// certificate. CertFile and keyFile are the client certificate for servers
+// that require one.
+type ControlConfig struct {
+	Port     uint16   `json:"port"`
+	TLS      bool     `json:"tls"`
+	CAFile   string   `json:"caFile"`
+	Pins     []string `json:"pins"`
+	Insecure bool     `json:"insecure"`
+	CertFile string   `json:"certFile"`
+	KeyFile  string   `json:"keyFile"`
+}
+
+// URL returns the url of path on the control endpoint of the server at
+// serverIP.
+func (c *ControlConfig) URL(serverIP, path string) string {
+	scheme, port := "http", uint16(80)
+	if c != nil && c.TLS {
+		scheme, port = "https", 443
+	}
+	if c != nil && c.Port != 0 {
+		port = c.Port
+	}
+	return scheme + "://" + net.JoinHostPort(serverIP, strconv.Itoa(int(port))) + path
+}
+
+func (c *ControlConfig) TLSConfig() (*tls.Config, error) {
+	tlsConfig, err := (&NegotiatorConfig{CAFile: c.CAFile, Pins: c.Pins, Insecure: c.Insecure}).TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// ListenForControl serves the control endpoint. It never returns.
+func (s *Server) ListenForControl() {
+	listenAddress := config.ControlListenAddress
+	if listenAddress == "" {
+		listenAddress = ":80"
+	}
+	server := &http.Server{
+		Addr:              listenAddress,
+		ReadHeaderTimeout: time.Second * 5,
+		ReadTimeout:       time.Second * 10,
+		WriteTimeout:      time.Second * 10,
+		Handler:           http.HandlerFunc(s.ServeControl),
+	}
+	s.Decoy = NewDecoy(config.Decoy)
+	s.Bans = NewBanManager(config.Bans)
+	go s.Bans.Expire()
+	if s.Bans.Config.AdminListenAddress != "" {
+		go s.Bans.ListenForAdmin()
+	}
+	if !config.ControlTLS {
+		log.Printf("Listening on %s for negotiation requests\n", listenAddress)
+		log.Panic(server.ListenAndServe())
+	}
+
+	certFile, keyFile := config.ControlCertFile, config.ControlKeyFile
+	if certFile == "" {
+		certFile = "control.crt"
+	}
+	if keyFile == "" {
+		keyFile = "control.key"
+	}
+	cert := LoadOrCreateCertificate(certFile, keyFile)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		log.Panic(err)
+	}
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+	log.Printf("Control certificate pin: %s\n", pin)
+	fmt.Printf("CONTROL PIN %s\n", pin)
+
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if config.ControlClientCAFile != "" {
+		data, err := os.ReadFile(config.ControlClientCAFile)
+		if err != nil {
+			log.Panic(err)
+		}
+		server.TLSConfig.ClientCAs = x509.NewCertPool()
+		if !server.TLSConfig.ClientCAs.AppendCertsFromPEM(data) {
+			log.Panicf("No certificates in %s\n", config.ControlClientCAFile)
+		}
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	log.Printf("Listening on %s for negotiation requests over tls\n", listenAddress)
+	log.Panic(server.ListenAndServeTLS("", ""))
+}
+
+// The control endpoint serves the session api:
+//
+//	POST   /v1/sessions             allocate a port for a client
+//	POST   /v1/sessions/{id}/punch  send the client a dummy packet
+//	POST   /v1/sessions/{id}/resume move the session to a new client port
+//	DELETE /v1/sessions/{id}        tear the session down
+//
+// Requests carry a SessionRequest with a sealed negotiation message whose
+// method and id have to match the route, responses a SessionResponse
+// with the status of the negotiation. Everything else, including messages
+// that are not signed with the secret, gets the decoy site. Messages on the
+// session api are relayed for clients, so their failures say nothing about
+// whoever relayed them. Only requests elsewhere that the decoy cannot answer
+// count as strikes, and banned ips are disconnected.
+type SessionRequest struct {
+	ClientIP string `json:"clientIP"`
+	Message  []byte `json:"message"`
+}
+
+type SessionResponse struct {
+	ID      string `json:"id,omitempty"`
+	Port    uint16 `json:"port,omitempty"`
+	Message []byte `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// sessionRoute returns the http method and path of the session api for a
+// negotiation method. Negotiators route by the id of the request, which is
+// different every time and does not name the session to whoever relays it,
+// but the server also accepts the handle it answered with in place of it.
+func sessionRoute(method byte, id string) (string, string) {
+	switch method {
+	case negotiateAllocate:
+		return http.MethodPost, "/v1/sessions"
+	case negotiatePunch:
+		return http.MethodPost, "/v1/sessions/" + id + "/punch"
+	case negotiateResume:
+		return http.MethodPost, "/v1/sessions/" + id + "/resume"
+	}
+	return http.MethodDelete, "/v1/sessions/" + id
+}
+
+func (s *Server) ServeControl(w http.ResponseWriter, r *http.Request) {
+	remoteIP := getIPFromAddress(r.RemoteAddr)
+	// negotiators with a client certificate are never banned
+	trusted := r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+	if !trusted && s.Bans.IsBanned(remoteIP) {
+		if hj, ok := w.(http.Hijacker); ok {
+			conn, _, _ := hj.Hijack()
+			conn.Close()
+			return
+		}
+		w.WriteHeader(500)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+	var method byte
+	var id string
+	switch {
+	case !strings.HasPrefix(r.URL.Path, "/v1/") || parts[0] != "sessions":
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		method = negotiateAllocate
+	case len(parts) == 3 && parts[2] == "punch" && r.Method == http.MethodPost:
+		method, id = negotiatePunch, parts[1]
+	case len(parts) == 3 && parts[2] == "resume" && r.Method == http.MethodPost:
+		method, id = negotiateResume, parts[1]
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		method, id = negotiateTearDown, parts[1]
+	}
+	var request SessionRequest
+	if method == 0 {
+		recorder := &statusRecorder{ResponseWriter: w, Status: 200}
+		s.Decoy.ServeHTTP(recorder, r)
+		if !trusted && !strings.HasPrefix(r.URL.Path, "/v1/") && recorder.Status >= 400 {
+			s.Bans.Strike(remoteIP, fmt.Sprintf("probed %s %s", r.Method, r.URL.Path))
+		}
+		return
+	}
+	// the decoy gets the body as it was sent
+	body, _ := io.ReadAll(io.LimitReader(r.Body, 2048))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if json.Unmarshal(body, &request) != nil || net.ParseIP(request.ClientIP) == nil {
+		log.Printf("Serving the decoy to %s for %s %s without a session request\n", remoteIP, r.Method, r.URL.Path)
+		s.Decoy.ServeHTTP(w, r)
+		return
+	}
+	if !VerifyNegotiationMAC(request.Message) {
+		log.Printf("Serving the decoy to %s for %s %s with an invalid mac for %s\n", remoteIP, r.Method, r.URL.Path, request.ClientIP)
+		negotiationMetrics.Add("invalid_mac", 1)
+		s.Decoy.ServeHTTP(w, r)
+		return
+	}
+
+	messageMethod, messageID, err := NegotiationRoute(request.Message)
+	if err != nil || messageMethod != method {
+		writeSessionResponse(w, http.StatusBadRequest, &SessionResponse{Error: "message does not match the route"})
+		return
+	}
+	// a route names the session either by the id of the request or by the
+	// handle of the session
+	var session string
+	if id != "" && id != messageID {
+		session = id
+	}
+	response, sealed, err := s.HandleNegotiationMessage(request.ClientIP, request.Message, session)
+	if err != nil {
+		writeSessionResponse(w, http.StatusBadRequest, &SessionResponse{Error: err.Error()})
+		return
+	}
+	writeSessionResponse(w, int(response.Status), &SessionResponse{ID: response.Session, Port: response.ServerPort, Message: sealed})
+}
+
+func writeSessionResponse(w http.ResponseWriter, status int, response *SessionResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// LoadOrCreateCertificate loads the certificate in certFile and keyFile, or
+// creates a self-signed one there if certFile does not exist.
+func LoadOrCreateCertificate(certFile, keyFile string) tls.Certificate {
+	if _, err := os.Stat(certFile); errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			log.Panic(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: new(big.Int).SetBytes(randomBytes(16)),
+			Subject:      pkix.Name{CommonName: "sneaky-tunnel"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().AddDate(10, 0, 0),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			log.Panic(err)
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			log.Panic(err)
+		}
+		if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+			log.Panic(err)
+		}
+		if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+			log.Panic(err)
+		}
+		log.Printf("Created self-signed certificate in %s\n", certFile)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		log.Panic(err)
+	}
+	return cert
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestControlPins(t *testing.T) {
+	dir := t.TempDir()
+	cert := LoadOrCreateCertificate(filepath.Join(dir, "control.crt"), filepath.Join(dir, "control.key"))
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	control := &testCertificate{cert: leaf, key: cert.PrivateKey.(*ecdsa.PrivateKey)}
+	attacker := newTestCertificate(t, "attacker", nil, false)
+
+	tests := []struct {
+		name  string
+		chain []*testCertificate
+		ok    bool
+	}{
+		{"control certificate", []*testCertificate{control}, true},
+		{"other certificate", []*testCertificate{attacker}, false},
+		{"control certificate appended", []*testCertificate{attacker, control}, false},
+	}
+	for _, test := range tests {
+		tlsConfig, err := (&ControlConfig{TLS: true, Insecure: true, Pins: []string{control.pin()}}).TLSConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testTLSHandshake(tlsConfig, test.chain...); (err == nil) != test.ok {
+			t.Errorf("%s: handshake returned %v", test.name, err)
+		}
+	}
+}
+
+// serveTestControl seals request for s and serves it on the route of path,
+// where {id} is replaced with the id of the request.
+func serveTestControl(t *testing.T, s *Server, httpMethod, path string, request *NegotiationRequest) (int, *SessionResponse) {
+	t.Helper()
+	message, _, err := SealNegotiationRequest(request, s.PrivateKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, id, _ := NegotiationRoute(message)
+	body, _ := json.Marshal(SessionRequest{ClientIP: "127.0.0.1", Message: message})
+	recorder := httptest.NewRecorder()
+	s.ServeControl(recorder, httptest.NewRequest(httpMethod, strings.Replace(path, "{id}", id, 1), bytes.NewReader(body)))
+	var response SessionResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, &response
+}
+
+// newTestControlServer returns a server that can serve its session api
+// without rate limits.
+func newTestControlServer(t *testing.T) *Server {
+	t.Helper()
+	s := newTestServer()
+	s.PrivateKey = testServerKey(t)
+	s.Decoy = http.NotFoundHandler()
+	s.Bans = NewBanManager(&BanConfig{StateFile: filepath.Join(t.TempDir(), "bans.json")})
+	s.SessionLimiter = NewSourceRateLimiter(nil, RateLimitConfig{Global: -1})
+	s.PunchLimiter = NewSourceRateLimiter(nil, RateLimitConfig{Global: -1})
+	return s
+}
+
+func TestControlSessionHandle(t *testing.T) {
+	s := newTestControlServer(t)
+
+	allocate := func(port uint16) (*NegotiationRequest, string) {
+		request := testNegotiationRequest(negotiateAllocate, nil)
+		request.ClientPort = port
+		status, response := serveTestControl(t, s, http.MethodPost, "/v1/sessions", request)
+		if status != 200 || response.ID == "" {
+			t.Fatalf("allocate answered with %d, %+v", status, response)
+		}
+		t.Cleanup(func() {
+			request.Method = negotiateTearDown
+			serveTestControl(t, s, http.MethodDelete, "/v1/sessions/{id}", request)
+		})
+		return request, response.ID
+	}
+	first, handle := allocate(40001)
+	second, otherHandle := allocate(40002)
+	if handle == otherHandle {
+		t.Fatalf("two sessions share the handle %s", handle)
+	}
+
+	punch := *first
+	punch.Method = negotiatePunch
+	stolen := *second
+	stolen.Method = negotiatePunch
+	tests := []struct {
+		name    string
+		path    string
+		request *NegotiationRequest
+		status  int
+	}{
+		{"request id", "/v1/sessions/{id}/punch", &punch, 200},
+		{"session handle", "/v1/sessions/" + handle + "/punch", &punch, 200},
+		{"handle of another session", "/v1/sessions/" + otherHandle + "/punch", &punch, 400},
+		{"token of another session", "/v1/sessions/" + handle + "/punch", &stolen, 400},
+		{"unknown handle", "/v1/sessions/0123456789abcdef/punch", &punch, 400},
+	}
+	for _, test := range tests {
+		status, response := serveTestControl(t, s, http.MethodPost, test.path, test.request)
+		if status != test.status {
+			t.Errorf("%s: answered with %d, want %d", test.name, status, test.status)
+		}
+		if status == 200 && response.ID != handle {
+			t.Errorf("%s: answered with the id %q, want the handle %q", test.name, response.ID, handle)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// NewDecoy returns the handler for requests to the control endpoint that are
+// not authenticated negotiation requests, so probers see an ordinary web
+// site. decoy is a directory to serve files from or the url of a site to
+// proxy to. Without one everything is not found.
+func NewDecoy(decoy string) http.Handler {
+	if decoy == "" {
+		return http.NotFoundHandler()
+	}
+	if !strings.HasPrefix(decoy, "http://") && !strings.HasPrefix(decoy, "https://") {
+		return http.FileServer(decoyFileSystem{http.Dir(decoy)})
+	}
+	target, err := url.Parse(decoy)
+	if err != nil || target.Host == "" {
+		log.Panicf("Invalid decoy %s\n", decoy)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = target.Host
+		// keeps the proxy from adding the prober's ip
+		r.Header["X-Forwarded-For"] = nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Decoy %s failed\n%s\n", decoy, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy
+}
+
+// decoyFileSystem hides directories without an index.html, which
+// http.FileServer would otherwise list.
+type decoyFileSystem struct {
+	http.FileSystem
+}
+
+func (fs decoyFileSystem) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := f.Stat(); err == nil && stat.IsDir() {
+		index, err := fs.FileSystem.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Just enough of the dns wire format (rfc 1035) for the negotiator to answer
+// TXT queries used by dns signaling.
+const (
+	dnsTypeTXT       = 16
+	dnsRcodeSuccess  = 0
+	dnsRcodeFormat   = 1
+	dnsRcodeNXDomain = 3
+	dnsRcodeRefused  = 5
+)
+
+type DNSQuestion struct {
+	ID    uint16
+	Name  string
+	Type  uint16
+	Flags uint16
+	End   int // offset of the end of the question section
+}
+
+func ParseDNSQuestion(msg []byte) (*DNSQuestion, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("short dns message")
+	}
+	q := &DNSQuestion{ID: uint16(msg[0])<<8 | uint16(msg[1]), Flags: uint16(msg[2])<<8 | uint16(msg[3])}
+	if q.Flags&0x8000 != 0 || msg[4] != 0 || msg[5] != 1 {
+		return nil, errors.New("not a query with one question")
+	}
+	var labels []string
+	offset := 12
+	for {
+		if offset >= len(msg) {
+			return nil, errors.New("short dns question")
+		}
+		length := int(msg[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		if length > 63 || offset+length > len(msg) {
+			return nil, errors.New("invalid dns label")
+		}
+		labels = append(labels, string(msg[offset:offset+length]))
+		offset += length
+	}
+	if offset+4 > len(msg) {
+		return nil, errors.New("short dns question")
+	}
+	q.Name = strings.ToLower(strings.Join(labels, "."))
+	q.Type = uint16(msg[offset])<<8 | uint16(msg[offset+1])
+	q.End = offset + 4
+	return q, nil
+}
+
+// BuildDNSResponse answers the question in query with rcode and, if txt is
+// not empty, a single TXT record that must not be cached.
+func BuildDNSResponse(query []byte, q *DNSQuestion, rcode byte, txt string) []byte {
+	flags := 0x8400 | q.Flags&0x0100 | uint16(rcode) // response, authoritative, recursion desired copied
+	response := []byte{byte(q.ID >> 8), byte(q.ID), byte(flags >> 8), byte(flags), 0, 1, 0, 0, 0, 0, 0, 0}
+	response = append(response, query[12:q.End]...)
+	if txt == "" {
+		return response
+	}
+	if len(txt) > 255 {
+		txt = txt[:255]
+	}
+	response[7] = 1
+	response = append(response, 0xc0, 12, 0, dnsTypeTXT, 0, 1, 0, 0, 0, 0)
+	response = append(response, byte((len(txt)+1)>>8), byte(len(txt)+1), byte(len(txt)))
+	return append(response, txt...)
+}
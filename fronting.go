@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NegotiatorConfig describes how to reach a negotiator. Everything but the
+// url is optional and lets requests be fronted through a cdn edge: the
+// connection goes to dialAddress (or the url's host), the tls handshake
+// names sni, and the request names host, which is where the cdn routes it.
+// Path replaces the url's path, with {random} replaced by random hex and
+// {server} by the server's ip. In config files a negotiator can also be
+// given as just its url.
+//
+// Certificates are verified against the system roots, or the ones in caFile,
+// for the sni (or the url's host). Pins are base64 sha256 hashes of the
+// subject public key info of a certificate in the verified chain, optionally
+// prefixed with "sha256/"; when set one of them has to match. Insecure skips
+// the verification against roots, which together with pins suits
+// self-signed negotiators, and then only the negotiator's own certificate
+// can match a pin.
+type NegotiatorConfig struct {
+	Name        string            `json:"name"`
+	URL         string            `json:"url"`
+	SNI         string            `json:"sni"`
+	Host        string            `json:"host"`
+	DialAddress string            `json:"dialAddress"`
+	Headers     map[string]string `json:"headers"`
+	Path        string            `json:"path"`
+	CAFile      string            `json:"caFile"`
+	Pins        []string          `json:"pins"`
+	Insecure    bool              `json:"insecure"`
+
+	clients map[string]*http.Client
+	mu      sync.Mutex
+}
+
+func (c *NegotiatorConfig) UnmarshalJSON(data []byte) error {
+	var u string
+	if json.Unmarshal(data, &u) == nil {
+		c.URL = u
+		return nil
+	}
+	type plain NegotiatorConfig
+	return json.Unmarshal(data, (*plain)(c))
+}
+
+// String returns the name of the negotiator, which defaults to its url and
+// host.
+func (c *NegotiatorConfig) String() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if c.Host != "" {
+		return c.URL + " (" + c.Host + ")"
+	}
+	return c.URL
+}
+
+// NewRequest builds a request to the negotiator for the server at serverIP.
+func (c *NegotiatorConfig) NewRequest(method, serverIP string, body []byte) (*http.Request, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if c.Path != "" {
+		u.Path = strings.NewReplacer("{random}", hex.EncodeToString(randomBytes(8)), "{server}", serverIP).Replace(c.Path)
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Host != "" {
+		req.Host = c.Host
+	}
+	for key, value := range c.Headers {
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+// Client returns the http client for negotiating with the server at
+// serverIP. The negotiator is reached over the same address family as the
+// server, because the address it sees is the one the server punches to.
+func (c *NegotiatorConfig) Client(serverIP string) *http.Client {
+	network := "tcp4"
+	if udpNetwork(serverIP) == "udp6" {
+		network = "tcp6"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clients == nil {
+		c.clients = make(map[string]*http.Client)
+	}
+	if client, ok := c.clients[network]; ok {
+		return client
+	}
+	tlsConfig, err := c.TLSConfig()
+	if err != nil {
+		log.Panicf("Invalid tls settings for negotiator %s: %s\n", c, err)
+	}
+	dialAddress := c.DialAddress
+	client := &http.Client{
+		Timeout: time.Second * 5,
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				if dialAddress != "" {
+					if _, _, err := net.SplitHostPort(dialAddress); err != nil {
+						addr = net.JoinHostPort(dialAddress, getPortFromAddress(addr))
+					} else {
+						addr = dialAddress
+					}
+				}
+				if negotiationProxy != nil {
+					return dialThroughProxy(ctx, negotiationProxy, addr)
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	c.clients[network] = client
+	return client
+}
+
+func (c *NegotiatorConfig) TLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: c.SNI, InsecureSkipVerify: c.Insecure}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.CAFile)
+		}
+	}
+	if len(c.Pins) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range c.Pins {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin %s", pin)
+			}
+			pins[string(decoded)] = true
+		}
+		// the peer sends whatever chain it likes, so without verification
+		// only its own certificate counts and with it only the verified
+		// chains do
+		insecure := c.Insecure
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if insecure {
+				if len(state.PeerCertificates) > 0 && pinMatches(pins, state.PeerCertificates[0]) {
+					return nil
+				}
+				return errPinMismatch
+			}
+			for _, chain := range state.VerifiedChains {
+				for _, cert := range chain {
+					if pinMatches(pins, cert) {
+						return nil
+					}
+				}
+			}
+			return errPinMismatch
+		}
+	}
+	return tlsConfig, nil
+}
+
+var errPinMismatch = errors.New("no certificate matches the pinned keys")
+
+func pinMatches(pins map[string]bool, cert *x509.Certificate) bool {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pins[string(sum[:])]
+}
+
+// isTLSVerificationError reports whether err means the negotiator could not
+// prove who it is, which can mean the connection is being intercepted.
+func isTLSVerificationError(err error) bool {
+	var verificationError *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	return errors.Is(err, errPinMismatch) || errors.As(err, &verificationError) || errors.As(err, &unknownAuthority) || errors.As(err, &hostname)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCertificate returns a certificate for negotiator.test signed by
+// parent, or self-signed without one.
+func newTestCertificate(t *testing.T, name string, parent *testCertificate, isCA bool) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          new(big.Int).SetBytes(randomBytes(16)),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"negotiator.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{cert: cert, key: key}
+}
+
+func (c *testCertificate) pin() string {
+	sum := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// testTLSHandshake connects a client with config to a server that sends
+// chain and proves it has the key of the first certificate in it.
+func testTLSHandshake(config *tls.Config, chain ...*testCertificate) error {
+	serverCert := tls.Certificate{PrivateKey: chain[0].key}
+	for _, c := range chain {
+		serverCert.Certificate = append(serverCert.Certificate, c.cert.Raw)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		serverConn.SetDeadline(time.Now().Add(time.Second * 5))
+		tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{serverCert}}).Handshake()
+		serverConn.Close()
+	}()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Now().Add(time.Second * 5))
+	config.ServerName = "negotiator.test"
+	return tls.Client(clientConn, config).Handshake()
+}
+
+func TestNegotiatorPins(t *testing.T) {
+	ca := newTestCertificate(t, "ca", nil, true)
+	leaf := newTestCertificate(t, "leaf", ca, false)
+	selfSigned := newTestCertificate(t, "self-signed", nil, false)
+	attacker := newTestCertificate(t, "attacker", nil, false)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		negotiator *NegotiatorConfig
+		chain      []*testCertificate
+		ok         bool
+	}{
+		{"insecure with the leaf pinned", &NegotiatorConfig{Insecure: true, Pins: []string{selfSigned.pin()}}, []*testCertificate{selfSigned}, true},
+		{"insecure with another key", &NegotiatorConfig{Insecure: true, Pins: []string{selfSigned.pin()}}, []*testCertificate{attacker}, false},
+		{"insecure with the pinned certificate appended", &NegotiatorConfig{Insecure: true, Pins: []string{selfSigned.pin()}}, []*testCertificate{attacker, selfSigned}, false},
+		{"ca pinned", &NegotiatorConfig{CAFile: caFile, Pins: []string{ca.pin()}}, []*testCertificate{leaf}, true},
+		{"leaf pinned", &NegotiatorConfig{CAFile: caFile, Pins: []string{leaf.pin()}}, []*testCertificate{leaf, ca}, true},
+		{"unverified certificate appended and pinned", &NegotiatorConfig{CAFile: caFile, Pins: []string{attacker.pin()}}, []*testCertificate{leaf, attacker}, false},
+		{"untrusted chain", &NegotiatorConfig{CAFile: caFile, Pins: []string{ca.pin()}}, []*testCertificate{attacker, ca}, false},
+	}
+	for _, test := range tests {
+		tlsConfig, err := test.negotiator.TLSConfig()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		err = testTLSHandshake(tlsConfig, test.chain...)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: handshake returned %v", test.name, err)
+		}
+		if err != nil && !isTLSVerificationError(err) {
+			t.Errorf("%s: %v is not a verification error", test.name, err)
+		}
+	}
+}
+
+func TestInvalidPins(t *testing.T) {
+	for _, pin := range []string{"sha256/not base64", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := (&NegotiatorConfig{Pins: []string{pin}}).TLSConfig(); err == nil {
+			t.Errorf("pin %q was accepted", pin)
+		}
+	}
+}
@@ -1,3 +1,3 @@
 module sneaky-tunnel
 
-go 1.19
+go 1.20
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+// Some packets prove that they come from one end of a negotiated session:
+//
+//	[flags][0][body][hmac (16)]
+//
+// The hmac is keyed with the session key and covers the flags, the body and
+// which side sent the packet, so a packet cannot be reflected back to its
+// sender. Dummy and address change packets carry a timestamp in nanoseconds
+// as their body and are not accepted once a newer one has been seen.
+//
+// Until a session has received a valid dummy packet the server drops
+// everything else on its port without answering, and afterwards it only
+// listens to the address the dummy packet came from. The server answers every
+// valid dummy packet with one of its own. The client's first dummy packet,
+// sent before the punch, is lost when the server's side is filtered, so once
+// the punch came through the client sends dummy packets every
+// dummyPacketInterval until one of them is answered. A client whose address
+// changed sends an address change packet from the new one, the server
+// answers with a path challenge there and only moves the session over once
+// the client has sent the challenge back from the same address.
+const (
+	fromClient = 'c'
+	fromServer = 's'
+
+	timestampedPacketLength = 2 + 8 + 16
+	pathChallengeLength     = 16
+	dummyPacketInterval     = time.Millisecond * 500
+)
+
+func packetMAC(flags byte, key []byte, direction byte, body []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte{direction, flags})
+	h.Write(body)
+	return h.Sum(nil)[:16]
+}
+
+// SignedPacket returns a packet with flags and body sent by direction.
+func SignedPacket(flags byte, key []byte, direction byte, body []byte) []byte {
+	return append(append([]byte{flags, 0}, body...), packetMAC(flags, key, direction, body)...)
+}
+
+// VerifySignedPacket checks that b is a packet with flags sent by direction
+// and returns its body.
+func VerifySignedPacket(b []byte, flags byte, key []byte, direction byte) ([]byte, bool) {
+	if len(b) < 2+16 || b[0] != flags {
+		return nil, false
+	}
+	body := b[2 : len(b)-16]
+	if !hmac.Equal(b[len(b)-16:], packetMAC(flags, key, direction, body)) {
+		return nil, false
+	}
+	return body, true
+}
+
+func TimestampedPacket(flags byte, key []byte, direction byte) []byte {
+	return SignedPacket(flags, key, direction, binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())))
+}
+
+// VerifyTimestampedPacket checks that b is a packet with flags sent by
+// direction that is newer than after and not older than maxNegotiationAge,
+// and returns its timestamp.
+func VerifyTimestampedPacket(b []byte, flags byte, key []byte, direction byte, after int64) (int64, bool) {
+	if len(b) != timestampedPacketLength {
+		return 0, false
+	}
+	body, ok := VerifySignedPacket(b, flags, key, direction)
+	if !ok {
+		return 0, false
+	}
+	t := int64(binary.BigEndian.Uint64(body))
+	age := time.Since(time.Unix(0, t))
+	if t <= after || age > maxNegotiationAge || age < -maxNegotiationAge {
+		return 0, false
+	}
+	return t, true
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func timestampedPacketAt(flags byte, key []byte, direction byte, t time.Time) []byte {
+	return SignedPacket(flags, key, direction, binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano())))
+}
+
+func TestVerifyTimestampedPacket(t *testing.T) {
+	key := randomBytes(negotiationKeyLength)
+	now := time.Now()
+	packet := timestampedPacketAt(14, key, fromClient, now)
+	tampered := append([]byte{}, packet...)
+	tampered[5] ^= 1
+	tests := []struct {
+		name      string
+		b         []byte
+		flags     byte
+		key       []byte
+		direction byte
+		after     int64
+		ok        bool
+	}{
+		{"valid", packet, 14, key, fromClient, 0, true},
+		{"newer than the last", packet, 14, key, fromClient, now.UnixNano() - 1, true},
+		{"wrong flags", packet, 1, key, fromClient, 0, false},
+		{"wrong key", packet, 14, randomBytes(negotiationKeyLength), fromClient, 0, false},
+		{"reflected", packet, 14, key, fromServer, 0, false},
+		{"tampered", tampered, 14, key, fromClient, 0, false},
+		{"replayed", packet, 14, key, fromClient, now.UnixNano(), false},
+		{"older than the last", packet, 14, key, fromClient, now.UnixNano() + 1, false},
+		{"stale", timestampedPacketAt(14, key, fromClient, now.Add(-maxNegotiationAge-time.Second)), 14, key, fromClient, 0, false},
+		{"too far ahead", timestampedPacketAt(14, key, fromClient, now.Add(maxNegotiationAge+time.Second)), 14, key, fromClient, 0, false},
+		{"short", packet[:timestampedPacketLength-1], 14, key, fromClient, 0, false},
+		{"long", SignedPacket(14, key, fromClient, append(binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano())), 0)), 14, key, fromClient, 0, false},
+	}
+	for _, test := range tests {
+		timestamp, ok := VerifyTimestampedPacket(test.b, test.flags, test.key, test.direction, test.after)
+		if ok != test.ok {
+			t.Errorf("%s: VerifyTimestampedPacket = %t, want %t", test.name, ok, test.ok)
+		}
+		if ok && timestamp != now.UnixNano() {
+			t.Errorf("%s: timestamp %d, want %d", test.name, timestamp, now.UnixNano())
+		}
+	}
+}
+
+func TestTimestampedPacketIsFresh(t *testing.T) {
+	key := randomBytes(negotiationKeyLength)
+	if _, ok := VerifyTimestampedPacket(TimestampedPacket(1, key, fromServer), 1, key, fromServer, 0); !ok {
+		t.Error("a fresh dummy packet was rejected")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTP/1.1 proxy front end of the client. CONNECT requests and plain requests
+// with an absolute URI are both carried to their destination as streams.
+const httpProxyHandshakeTime = time.Second * 10
+
+// proxiedConn reads from reader instead of the connection itself, so bytes
+// that were already buffered or rewritten are sent first.
+type proxiedConn struct {
+	*net.TCPConn
+	reader io.Reader
+}
+
+func (p *proxiedConn) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+func (c *Client) ListenForHTTPProxy() {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Println("panic occurred:", e)
+		}
+	}()
+	listener, err := net.Listen("tcp", config.HTTPProxyListenAddress)
+	if err != nil {
+		log.Panicln(err)
+	}
+	log.Printf("Listening on %s for http proxy connections\n", listener.Addr().String())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Panicln(err)
+		}
+		go c.HandleHTTPProxyConnection(conn.(*net.TCPConn))
+	}
+}
+
+func (c *Client) HandleHTTPProxyConnection(conn *net.TCPConn) {
+	conn.SetDeadline(time.Now().Add(httpProxyHandshakeTime))
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	var destination string
+	if req.Method == http.MethodConnect {
+		destination = req.Host
+	} else if req.URL.IsAbs() && req.URL.Scheme == "http" {
+		destination = req.URL.Host
+		if req.URL.Port() == "" {
+			destination = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	} else {
+		writeHTTPProxyError(conn, http.StatusBadRequest)
+		return
+	}
+	announcement, err := EncodeDestination(destination)
+	if err != nil {
+		writeHTTPProxyError(conn, http.StatusBadRequest)
+		return
+	}
+	if !c.Ready {
+		log.Printf("Tunnel is not ready, dropping http proxy request from %s\n", conn.RemoteAddr().String())
+		writeHTTPProxyError(conn, http.StatusServiceUnavailable)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	proxied := &proxiedConn{TCPConn: conn, reader: reader}
+	var pr *io.PipeReader
+	if req.Method != http.MethodConnect {
+		// forward only this request, in origin form, with its body; the
+		// connection is closed after the response, so anything the client
+		// pipelines after it is never read
+		req.RequestURI = ""
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authorization")
+		req.Close = true
+		var pw *io.PipeWriter
+		pr, pw = io.Pipe()
+		go func() {
+			pw.CloseWithError(req.Write(pw))
+		}()
+		proxied.reader = pr
+	}
+
+	// CONNECT is answered once the server has connected to the destination
+	id, err := c.OpenStream(proxied, announcement, func(reason byte) {
+		switch {
+		case reason == streamOpened && req.Method == http.MethodConnect:
+			conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		case reason == streamResetTimedOut:
+			writeHTTPProxyError(conn, http.StatusGatewayTimeout)
+		case reason != streamOpened:
+			writeHTTPProxyError(conn, http.StatusBadGateway)
+		}
+	})
+	if err != nil {
+		log.Printf("Dropping http proxy connection from %s\n%s\n", conn.RemoteAddr().String(), err)
+		if pr != nil {
+			pr.Close()
+		}
+		if err == errNoFreeID {
+			writeHTTPProxyError(conn, http.StatusServiceUnavailable)
+		}
+		return
+	}
+	log.Printf("Accepted http proxy connection from %s to %s with id of %d\n", conn.RemoteAddr().String(), destination, id)
+}
+
+func writeHTTPProxyError(conn net.Conn, status int) {
+	(&http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Close:      true,
+	}).Write(conn)
+	conn.Close()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// httpProxyTestRequest writes raw to a new http proxy connection of c and
+// returns the response, the connection and its reader.
+func httpProxyTestRequest(t *testing.T, c *Client, raw string) (*http.Response, net.Conn, *bufio.Reader) {
+	t.Helper()
+	app, local := tcpTestPair(t)
+	go c.HandleHTTPProxyConnection(local)
+	app.Write([]byte(raw))
+	app.SetReadDeadline(time.Now().Add(time.Second * 5))
+	reader := bufio.NewReader(app)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("reading the response failed: %s", err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response, app, reader
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	c := newTestProxyClient(t)
+	destination := listenTestTCP(t, echoTestTCP)
+	address, _ := DecodeDestination(destination)
+	response, app, reader := httpProxyTestRequest(t, c, fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", address, address))
+	if response.StatusCode != 200 {
+		t.Fatalf("connect answered with %d", response.StatusCode)
+	}
+	app.Write([]byte("hello"))
+	echo := make([]byte, 5)
+	if _, err := io.ReadFull(reader, echo); err != nil || string(echo) != "hello" {
+		t.Errorf("read %q, %v, want the echo", echo, err)
+	}
+}
+
+func TestHTTPProxyRequest(t *testing.T) {
+	c := newTestProxyClient(t)
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer origin.Close()
+
+	// a second request pipelined after the first is not forwarded
+	response, _, reader := httpProxyTestRequest(t, c, fmt.Sprintf("GET %s/first HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\n\r\nGET /second HTTP/1.1\r\nHost: %s\r\n\r\n", origin.URL, origin.Listener.Addr(), origin.Listener.Addr()))
+	body, err := io.ReadAll(response.Body)
+	if err != nil || response.StatusCode != 200 || string(body) != "/first" {
+		t.Fatalf("request answered with %d, %q, %v", response.StatusCode, body, err)
+	}
+	if rest, _ := io.ReadAll(reader); len(rest) > 0 || requests.Load() != 1 {
+		t.Errorf("origin served %d requests and sent %q after the first response, want 1", requests.Load(), rest)
+	}
+}
+
+func TestHTTPProxyErrors(t *testing.T) {
+	c := newTestProxyClient(t)
+	refused := refusedTestDestination(t)
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"refused", fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", refused, refused), http.StatusBadGateway},
+		{"origin form", "GET /path HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusBadRequest},
+		{"https", "GET https://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if response, _, _ := httpProxyTestRequest(t, c, test.raw); response.StatusCode != test.status {
+			t.Errorf("%s: answered with %d, want %d", test.name, response.StatusCode, test.status)
+		}
+	}
+}
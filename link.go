@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A server that sets negotiatorLink needs no inbound tcp port: it long-polls
+// the negotiator instead, which hands it the negotiation messages of its
+// clients and takes the responses back.
+//
+//	POST /link/poll      LinkPoll -> LinkPollResponse, held for up to linkPollTimeout
+//	POST /link/response  LinkResponse
+//
+// Both need the server's linkSecret as a bearer token. Every server has its
+// own, which the negotiator lists for each of the server's ips in
+// linkSecrets, so a server can only claim the ips it was given a secret for.
+// A poll acknowledges the events handed out by the previous one, and events
+// that were not acknowledged, because the response to that poll never
+// arrived, are handed out again. Messages for servers without a live link are
+// relayed over http as before.
+const (
+	linkPollTimeout  = time.Second * 20
+	linkRelayTimeout = time.Second * 8
+	linkQueueLength  = 64
+)
+
+type LinkPoll struct {
+	// Servers are the ips clients use for the server. When empty the ip the
+	// poll came from is used.
+	Servers []string `json:"servers"`
+	// Received are the ids of the events in the previous poll response.
+	Received []string `json:"received,omitempty"`
+}
+
+type LinkEvent struct {
+	ID       string `json:"id"`
+	ClientIP string `json:"clientIP"`
+	Message  []byte `json:"message"`
+}
+
+type LinkPollResponse struct {
+	Events []LinkEvent `json:"events"`
+}
+
+type LinkResponse struct {
+	ID      string `json:"id"`
+	Status  int    `json:"status"`
+	Message []byte `json:"message"`
+}
+
+// ServerLink is the negotiator's side of a server's long-poll.
+type ServerLink struct {
+	Events         chan LinkEvent
+	LastPoll       time.Time
+	Secret         string
+	Unacknowledged []LinkEvent
+}
+
+// PendingLinkResponse waits for the response to an event sent over Link.
+type PendingLinkResponse struct {
+	Link     *ServerLink
+	Response chan LinkResponse
+}
+
+func (n *Negotiator) IsLinkRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/link/")
+}
+
+func (n *Negotiator) ServeLink(w http.ResponseWriter, r *http.Request, remoteIP string) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if r.Method != http.MethodPost || !n.IsLinkSecret(token) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.URL.Path {
+	case "/link/poll":
+		var poll LinkPoll
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&poll); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(poll.Servers) == 0 {
+			poll.Servers = []string{remoteIP}
+		}
+		link := n.Link(poll.Servers, token)
+		if link == nil {
+			log.Printf("Rejected link from %s for %s\n", remoteIP, strings.Join(poll.Servers, ", "))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		n.Requeue(link, poll.Received)
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(linkPollTimeout + time.Second*5))
+		var response LinkPollResponse
+		select {
+		case event := <-link.Events:
+			response.Events = append(response.Events, event)
+			for len(link.Events) > 0 {
+				response.Events = append(response.Events, <-link.Events)
+			}
+		case <-time.After(linkPollTimeout):
+		case <-r.Context().Done():
+		}
+		n.LinkMutex.Lock()
+		link.LastPoll = time.Now()
+		link.Unacknowledged = append(link.Unacknowledged, response.Events...)
+		n.LinkMutex.Unlock()
+		json.NewEncoder(w).Encode(response)
+	case "/link/response":
+		var response LinkResponse
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&response); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n.LinkMutex.Lock()
+		pending, ok := n.PendingLinkResponses[response.ID]
+		// only the server the event was sent to can answer it
+		ok = ok && linkSecretMatches(pending.Link.Secret, token)
+		if ok {
+			delete(n.PendingLinkResponses, response.ID)
+		}
+		n.LinkMutex.Unlock()
+		if ok {
+			pending.Response <- response
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// IsLinkSecret reports whether token is the secret of any linked server.
+func (n *Negotiator) IsLinkSecret(token string) bool {
+	found := false
+	for _, secret := range n.LinkSecrets {
+		if linkSecretMatches(secret, token) {
+			found = true
+		}
+	}
+	return found
+}
+
+func linkSecretMatches(secret, token string) bool {
+	return secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+// Link returns the link of the server with serverIPs, creating it if needed,
+// or nil if any of the ips is not an allowed server or has another secret.
+func (n *Negotiator) Link(serverIPs []string, secret string) *ServerLink {
+	n.LinkMutex.Lock()
+	defer n.LinkMutex.Unlock()
+	var link *ServerLink
+	for i, ip := range serverIPs {
+		parsed := net.ParseIP(ip)
+		if parsed == nil || !n.IsAllowedServer(parsed.String()) || !linkSecretMatches(n.LinkSecrets[parsed.String()], secret) {
+			return nil
+		}
+		serverIPs[i] = parsed.String()
+		if link == nil {
+			link = n.Links[serverIPs[i]]
+		}
+	}
+	if link == nil {
+		link = &ServerLink{Events: make(chan LinkEvent, linkQueueLength), Secret: secret}
+		log.Printf("Server at %s linked\n", strings.Join(serverIPs, ", "))
+	}
+	link.LastPoll = time.Now()
+	for _, ip := range serverIPs {
+		n.Links[ip] = link
+	}
+	return link
+}
+
+// Requeue hands the events of the link's previous polls that are not in
+// received out again, unless their relay has given up on them already. The
+// server answers events it gets twice from its cache.
+func (n *Negotiator) Requeue(link *ServerLink, received []string) {
+	acknowledged := make(map[string]bool)
+	for _, id := range received {
+		acknowledged[id] = true
+	}
+	n.LinkMutex.Lock()
+	defer n.LinkMutex.Unlock()
+	for _, event := range link.Unacknowledged {
+		if _, ok := n.PendingLinkResponses[event.ID]; !ok || acknowledged[event.ID] {
+			continue
+		}
+		select {
+		case link.Events <- event:
+		default:
+		}
+	}
+	link.Unacknowledged = nil
+}
+
+// LiveLink returns the link of the server at serverIP if it has polled
+// recently.
+func (n *Negotiator) LiveLink(serverIP string) *ServerLink {
+	n.LinkMutex.Lock()
+	defer n.LinkMutex.Unlock()
+	link, ok := n.Links[serverIP]
+	if !ok || time.Since(link.LastPoll) > linkPollTimeout+time.Second*10 {
+		return nil
+	}
+	return link
+}
+
+// RelayOverLink passes a message to a linked server and waits for its
+// response.
+func (n *Negotiator) RelayOverLink(link *ServerLink, clientIP string, message []byte) (int, []byte) {
+	event := LinkEvent{ID: hex.EncodeToString(randomBytes(8)), ClientIP: clientIP, Message: message}
+	pending := &PendingLinkResponse{Link: link, Response: make(chan LinkResponse, 1)}
+	n.LinkMutex.Lock()
+	n.PendingLinkResponses[event.ID] = pending
+	n.LinkMutex.Unlock()
+	defer func() {
+		n.LinkMutex.Lock()
+		delete(n.PendingLinkResponses, event.ID)
+		n.LinkMutex.Unlock()
+	}()
+
+	select {
+	case link.Events <- event:
+	default:
+		return http.StatusServiceUnavailable, nil
+	}
+	select {
+	case response := <-pending.Response:
+		return response.Status, response.Message
+	case <-time.After(linkRelayTimeout):
+		return http.StatusGatewayTimeout, nil
+	}
+}
+
+// PollNegotiator keeps a long-poll running to the negotiator and answers the
+// negotiation messages it hands over. It never returns.
+func (s *Server) PollNegotiator() {
+	c := config.NegotiatorLink
+	client := &http.Client{Transport: c.Client("").Transport, Timeout: linkPollTimeout + time.Second*10}
+	var received []string
+	retryDelay := time.Second
+	for {
+		body, _ := json.Marshal(LinkPoll{Servers: config.LinkServerIPs, Received: received})
+		res, err := s.postToLink(client, "/link/poll", body)
+		if err != nil {
+			log.Printf("Failed to poll negotiator %s, retrying in %s\n%s\n", c, retryDelay, err)
+			time.Sleep(retryDelay)
+			if retryDelay < time.Minute {
+				retryDelay *= 2
+			}
+			continue
+		}
+		retryDelay = time.Second
+		received = nil
+		var poll LinkPollResponse
+		err = json.NewDecoder(io.LimitReader(res.Body, 1024*1024)).Decode(&poll)
+		res.Body.Close()
+		if err != nil {
+			log.Printf("Invalid poll response from negotiator %s\n%s\n", c, err)
+			continue
+		}
+		for _, event := range poll.Events {
+			received = append(received, event.ID)
+			go func(event LinkEvent) {
+				response := LinkResponse{ID: event.ID, Status: 400}
+				if net.ParseIP(event.ClientIP) != nil {
+					if _, message, err := s.HandleNegotiationMessage(event.ClientIP, event.Message, ""); err == nil {
+						response.Status, response.Message = 200, message
+					}
+				}
+				body, _ := json.Marshal(response)
+				res, err := s.postToLink(client, "/link/response", body)
+				if err != nil {
+					log.Printf("Failed to send negotiation response to negotiator %s\n%s\n", c, err)
+					return
+				}
+				res.Body.Close()
+			}(event)
+		}
+	}
+}
+
+func (s *Server) postToLink(client *http.Client, path string, body []byte) (*http.Response, error) {
+	req, err := config.NegotiatorLink.NewRequest(http.MethodPost, "", body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Path = strings.TrimSuffix(req.URL.Path, "/") + path
+	req.Header.Set("Authorization", "Bearer "+config.LinkSecret)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, fmt.Errorf("POST %s responded with status %d", req.URL, res.StatusCode)
+	}
+	return res, nil
+}
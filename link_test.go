@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestLinkNegotiator() *Negotiator {
+	return &Negotiator{
+		Links:                make(map[string]*ServerLink),
+		LinkSecrets:          map[string]string{"203.0.113.1": "first secret", "203.0.113.2": "second secret"},
+		PendingLinkResponses: make(map[string]*PendingLinkResponse),
+	}
+}
+
+// postTestLink posts body as json to path of n's link api with secret.
+func postTestLink(n *Negotiator, path, secret string, body any) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(body)
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+	r.Header.Set("Authorization", "Bearer "+secret)
+	recorder := httptest.NewRecorder()
+	n.ServeLink(recorder, r, "192.0.2.1")
+	return recorder
+}
+
+// pollTestLink polls for the first server, acknowledging received, and
+// returns the ids of the events it was handed.
+func pollTestLink(t *testing.T, n *Negotiator, received []string) []string {
+	t.Helper()
+	recorder := postTestLink(n, "/link/poll", "first secret", LinkPoll{Servers: []string{"203.0.113.1"}, Received: received})
+	var response LinkPollResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); recorder.Code != 200 || err != nil {
+		t.Fatalf("poll answered with %d, %v", recorder.Code, err)
+	}
+	var ids []string
+	for _, event := range response.Events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+type testLinkRelay struct {
+	status  int
+	message []byte
+}
+
+// relayTestLink relays message over the link of the first server.
+func relayTestLink(n *Negotiator, message string) chan testLinkRelay {
+	relayed := make(chan testLinkRelay, 1)
+	link := n.Link([]string{"203.0.113.1"}, "first secret")
+	go func() {
+		status, message := n.RelayOverLink(link, "198.51.100.1", []byte(message))
+		relayed <- testLinkRelay{status, message}
+	}()
+	return relayed
+}
+
+func TestLinkRelay(t *testing.T) {
+	n := newTestLinkNegotiator()
+	relayed := relayTestLink(n, "request")
+	ids := pollTestLink(t, n, nil)
+	if len(ids) != 1 {
+		t.Fatalf("poll handed out %v, want one event", ids)
+	}
+
+	// only the server the event went to can answer it
+	postTestLink(n, "/link/response", "second secret", LinkResponse{ID: ids[0], Status: 200, Message: []byte("forged")})
+	postTestLink(n, "/link/response", "first secret", LinkResponse{ID: ids[0], Status: 200, Message: []byte("response")})
+	select {
+	case relay := <-relayed:
+		if relay.status != 200 || string(relay.message) != "response" {
+			t.Errorf("relay returned %d, %q", relay.status, relay.message)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("relay was not answered")
+	}
+}
+
+func TestLinkRequeue(t *testing.T) {
+	n := newTestLinkNegotiator()
+	relayTestLink(n, "first")
+	first := pollTestLink(t, n, nil)
+	// the response to the first poll was lost, so nothing is acknowledged
+	again := pollTestLink(t, n, nil)
+	if len(first) != 1 || len(again) != 1 || again[0] != first[0] {
+		t.Fatalf("polls handed out %v and %v, want the same event twice", first, again)
+	}
+	relayTestLink(n, "second")
+	next := pollTestLink(t, n, again)
+	if len(next) != 1 || next[0] == first[0] {
+		t.Errorf("poll after the acknowledgement handed out %v, want only the new event", next)
+	}
+	for _, id := range append(first, next...) {
+		postTestLink(n, "/link/response", "first secret", LinkResponse{ID: id, Status: 200})
+	}
+}
+
+func TestLinkSecrets(t *testing.T) {
+	n := newTestLinkNegotiator()
+	tests := []struct {
+		name    string
+		secret  string
+		servers []string
+		status  int
+	}{
+		{"unknown secret", "other secret", []string{"203.0.113.1"}, http.StatusNotFound},
+		{"secret of another server", "second secret", []string{"203.0.113.1"}, http.StatusForbidden},
+		{"claiming another server as well", "first secret", []string{"203.0.113.1", "203.0.113.2"}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if recorder := postTestLink(n, "/link/poll", test.secret, LinkPoll{Servers: test.servers}); recorder.Code != test.status {
+			t.Errorf("%s: poll answered with %d, want %d", test.name, recorder.Code, test.status)
+		}
+	}
+}
@@ -2,72 +2,159 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 )
 
 var config Config
 var logFile *os.File
-var httpClient *http.Client
+var dialer *net.Dialer
+var resolver *net.Resolver
+var negotiationProxy *url.URL
 
 type Config struct {
-	Role              string   `json:"role"`
-	ServicePorts      []uint16 `json:"servicePorts"`
-	ServerIP          string   `json:"serverIP"`
-	Negotiator        string   `json:"negotiator"`
-	Resolver          string   `json:"resolver"`
-	KeepAliveInterval []int    `json:"keepAliveInterval"`
-	RetryDelay        int      `json:"retryDelay"`
-	RetryCount        int      `json:"retryCount"`
-	SerivceTimeout    int      `json:"serviceTimeout"`
+	Role                   string              `json:"role"`
+	ServicePorts           []uint16            `json:"servicePorts"`
+	TCPServicePorts        []uint16            `json:"tcpServicePorts"`
+	ServerIP               string              `json:"serverIP"`
+	Negotiator             string              `json:"negotiator"`
+	Negotiators            []*NegotiatorConfig `json:"negotiators"`
+	NegotiatorStateFile    string              `json:"negotiatorStateFile"`
+	Resolver               string              `json:"resolver"`
+	Resolvers              []*ResolverConfig   `json:"resolvers"`
+	NegotiationProxy       string              `json:"negotiationProxy"`
+	KeepAliveInterval      []int               `json:"keepAliveInterval"`
+	RetryDelay             int                 `json:"retryDelay"`
+	RetryCount             int                 `json:"retryCount"`
+	SerivceTimeout         int                 `json:"serviceTimeout"`
+	Services               []Service           `json:"services"`
+	SOCKSListenAddress     string              `json:"socksListenAddress"`
+	HTTPProxyListenAddress string              `json:"httpProxyListenAddress"`
+	Tun                    *TunConfig          `json:"tun"`
+	ReverseServices        []Service           `json:"reverseServices"`
+	ReversePorts           []uint16            `json:"reversePorts"`
+	ListenAddress          string              `json:"listenAddress"`
+	CertFile               string              `json:"certFile"`
+	KeyFile                string              `json:"keyFile"`
+	Servers                []string            `json:"servers"`
+	ClientIPHeader         string              `json:"clientIPHeader"`
+	RateLimit              int                 `json:"rateLimit"`
+	RateLimitBurst         int                 `json:"rateLimitBurst"`
+	Signaling              string              `json:"signaling"`
+	SignalingDomain        string              `json:"signalingDomain"`
+	SignalingDirectory     string              `json:"signalingDirectory"`
+	STUNServer             string              `json:"stunServer"`
+	DNSListenAddress       string              `json:"dnsListenAddress"`
+	ServerPublicKey        string              `json:"serverPublicKey"`
+	PrivateKeyFile         string              `json:"privateKeyFile"`
+	Secret                 string              `json:"secret"`
+	NegotiatorLink         *NegotiatorConfig   `json:"negotiatorLink"`
+	LinkSecret             string              `json:"linkSecret"`
+	LinkSecrets            map[string]string   `json:"linkSecrets"`
+	LinkServerIPs          []string            `json:"linkServerIPs"`
+	ControlListenAddress   string              `json:"controlListenAddress"`
+	ControlTLS             bool                `json:"controlTLS"`
+	ControlCertFile        string              `json:"controlCertFile"`
+	ControlKeyFile         string              `json:"controlKeyFile"`
+	ControlClientCAFile    string              `json:"controlClientCAFile"`
+	ServerControl          *ControlConfig      `json:"serverControl"`
+	Decoy                  string              `json:"decoy"`
+	Bans                   *BanConfig          `json:"bans"`
+	SessionRateLimit       *RateLimitConfig    `json:"sessionRateLimit"`
+	PunchRateLimit         *RateLimitConfig    `json:"punchRateLimit"`
+	MetricsListenAddress   string              `json:"metricsListenAddress"`
 }
 
+// Service maps a port on the client to a destination on the server side.
+// Without a destination the same port on the server is used.
+type Service struct {
+	Protocol     string `json:"protocol"`
+	Port         uint16 `json:"port"`
+	Destination  string `json:"destination"`
+	Announcement []byte `json:"-"`
+}
+
+const (
+	handshakeTimeout   = time.Second * 10
+	happyEyeballsDelay = time.Millisecond * 250
+)
+
 func resolveAddress(adress string) *net.UDPAddr {
-	a, err := net.ResolveUDPAddr("udp4", adress)
+	a, err := net.ResolveUDPAddr("udp", adress)
 	if err != nil {
 		log.Panic(err)
 	}
 	return a
 }
 
-func getPortFromAddress(address string) string {
-	parts := strings.Split(address, ":")
-	return parts[len(parts)-1]
-}
-
-func getIPFromAddress(address string) string {
-	parts := strings.Split(address, ":")
-	return parts[0]
+// udpNetwork returns the network to use for talking to ip, so sockets are
+// opened in the same address family.
+func udpNetwork(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return "udp6"
+	}
+	return "udp4"
 }
 
-func isValidAddress(address string) bool {
-	if len(address) > 21 {
-		return false
+// resolveServerIPs returns the addresses of the server, alternating between
+// ipv6 and ipv4 starting with ipv6 as happy eyeballs (rfc 8305) suggests.
+func resolveServerIPs(host string) []string {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{ip.String()}
+	}
+	ips, err := resolver.LookupIP(context.Background(), "ip", host)
+	if err != nil {
+		log.Panicln(err)
+	}
+	var ipv4, ipv6, sorted []string
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip.String())
+		} else {
+			ipv6 = append(ipv6, ip.String())
+		}
 	}
-	addressParts := strings.Split(address, ":")
-	if len(addressParts) != 2 {
-		return false
+	for len(ipv4) > 0 || len(ipv6) > 0 {
+		if len(ipv6) > 0 {
+			sorted, ipv6 = append(sorted, ipv6[0]), ipv6[1:]
+		}
+		if len(ipv4) > 0 {
+			sorted, ipv4 = append(sorted, ipv4[0]), ipv4[1:]
+		}
 	}
-	ipParts := strings.Split(addressParts[0], ".")
-	if len(ipParts) != 4 {
-		return false
+	return sorted
+}
+
+func getPortFromAddress(address string) string {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return ""
 	}
-	_, err := strconv.ParseUint(addressParts[1], 10, 16)
+	return port
+}
+
+func portNumber(port string) uint16 {
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return uint16(p)
+}
+
+func getIPFromAddress(address string) string {
+	host, _, err := net.SplitHostPort(address)
 	if err != nil {
-		return false
+		return address
 	}
-	ip := net.ParseIP(addressParts[0])
-	return ip != nil
+	return host
 }
 
-func init() {
+// loadConfig reads the config from the file named by the first argument,
+// opens the log file named by the second one and sets up the resolver.
+func loadConfig() {
 	cPath := "config.json"
 	if len(os.Args) > 1 {
 		cPath = os.Args[1]
@@ -80,6 +167,56 @@ func init() {
 	if err != nil {
 		log.Panic(err)
 	}
+	if config.Negotiator != "" {
+		config.Negotiators = append([]*NegotiatorConfig{{URL: config.Negotiator}}, config.Negotiators...)
+	}
+	for _, port := range config.ServicePorts {
+		config.Services = append(config.Services, Service{Protocol: "udp", Port: port})
+	}
+	for _, port := range config.TCPServicePorts {
+		config.Services = append(config.Services, Service{Protocol: "tcp", Port: port})
+	}
+	for i := range config.Services {
+		service := &config.Services[i]
+		if service.Protocol == "" {
+			service.Protocol = "udp"
+		}
+		if service.Protocol != "udp" && service.Protocol != "tcp" {
+			log.Panicf("Unknown protocol %s for service on port %d\n", service.Protocol, service.Port)
+		}
+		if service.Destination == "" {
+			service.Announcement = Uint16ToByteSlice(service.Port)
+			continue
+		}
+		service.Announcement, err = EncodeDestination(service.Destination)
+		if err != nil {
+			log.Panicf("Invalid destination %s for service on port %d: %s\n", service.Destination, service.Port, err)
+		}
+	}
+	for i := range config.ReverseServices {
+		service := &config.ReverseServices[i]
+		if service.Protocol == "" {
+			service.Protocol = "udp"
+		}
+		if service.Protocol != "udp" && service.Protocol != "tcp" {
+			log.Panicf("Unknown protocol %s for reverse service on port %d\n", service.Protocol, service.Port)
+		}
+		if _, _, err := net.SplitHostPort(service.Destination); err != nil {
+			log.Panicf("Invalid destination %s for reverse service on port %d: %s\n", service.Destination, service.Port, err)
+		}
+	}
+	if config.NegotiationProxy != "" {
+		negotiationProxy, err = url.Parse(config.NegotiationProxy)
+		if err != nil || negotiationProxy.Host == "" {
+			log.Panicf("Invalid negotiationProxy %s\n", config.NegotiationProxy)
+		}
+	}
+	if (config.Role == "client" || config.Role == "server") && config.Secret == "" {
+		log.Panicln("secret is required to sign negotiation requests")
+	}
+	if config.NegotiatorLink != nil && config.LinkSecret == "" {
+		log.Panicln("linkSecret is required to link to a negotiator")
+	}
 
 	lPath := "logs.txt"
 	if len(os.Args) > 2 {
@@ -92,37 +229,43 @@ func init() {
 	log.SetOutput(logFile)
 	log.SetFlags(log.Ltime | log.Lshortfile)
 
-	dialer := &net.Dialer{
+	dialer = &net.Dialer{
 		Resolver: &net.Resolver{
 			PreferGo: true,
 			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				if len(config.Resolvers) > 0 {
+					return &resolverConn{Resolvers: config.Resolvers}, nil
+				}
 				d := net.Dialer{
 					Timeout: time.Second * 10,
 				}
 				if config.Resolver == "" {
 					return d.DialContext(ctx, "udp", "8.8.8.8"+":53")
 				} else {
-					return d.DialContext(ctx, "udp", config.Resolver+":53")
+					return d.DialContext(ctx, "udp", net.JoinHostPort(config.Resolver, "53"))
 				}
 			},
 		},
 	}
+	resolver = dialer.Resolver
 	dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
 		return dialer.DialContext(ctx, network, addr)
 	}
 	http.DefaultTransport.(*http.Transport).DialContext = dialContext
-	httpClient = &http.Client{
-		Timeout:   time.Second * 5,
-		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
-	}
 }
 
 func main() {
+	loadConfig()
 	defer logFile.Close()
 
+	if config.MetricsListenAddress != "" {
+		go ListenForMetrics()
+	}
 	if config.Role == "client" {
 		(&Client{}).Start()
 	} else if config.Role == "server" {
 		(&Server{}).Start()
+	} else if config.Role == "negotiator" {
+		(&Negotiator{}).Start()
 	}
 }
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+// Counters are published as json on metricsListenAddress, by the server
+// under "negotiation" and by the negotiator under "negotiator".
+var (
+	negotiationMetrics = expvar.NewMap("negotiation")
+	negotiatorMetrics  = expvar.NewMap("negotiator")
+)
+
+func ListenForMetrics() {
+	log.Printf("Listening on %s for metrics requests\n", config.MetricsListenAddress)
+	log.Panic(http.ListenAndServe(config.MetricsListenAddress, expvar.Handler()))
+}
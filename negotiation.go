@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Negotiation messages are sealed to the server's x25519 public key, so
+// whatever carries them (the negotiator, a cdn, a dns resolver) only learns
+// which server they are for and what they ask for. A sealed request is
+//
+//	[method][ephemeral public key (32)][aes-gcm ciphertext][hmac (16)]
+//
+// and its response is sealed with the same key. The method is readable so
+// negotiators can pick the route of the server's session api, and is
+// authenticated along with the ciphertext. The id in the route is taken
+// from the ephemeral key, which is new for every request, so requests of
+// the same session cannot be linked by anyone carrying them. The hmac is
+// keyed with the secret shared by the client and the server, so the server
+// can drop requests from anyone else before doing any work. Requests are
+//
+//	[version][method][client port (2)][token (16)][capabilities][key (16)]
+//	[timestamp (4)][client ip (0, 4 or 16)]
+//
+// and responses are
+//
+//	[version][status (2)][server port (2)][capabilities][key (32)]
+//
+// The token is chosen by the client when it asks for a port and has to be
+// repeated in the requests that follow, and resume requests carry the
+// session's ticket in place of a key. Clients whose negotiator cannot see
+// their address, because they go through a proxy or a dns resolver, add the
+// public ip they learned with STUN, and the server punches to it instead of
+// the ip it was relayed with. The keys of both sides are hashed into the
+// session key. Requests older than maxNegotiationAge are rejected, and the
+// ephemeral key doubles as a nonce for spotting repeats of newer ones.
+const (
+	negotiationVersion = 3
+
+	negotiateAllocate = 1
+	negotiatePunch    = 2
+	negotiateTearDown = 3
+	negotiateResume   = 4
+
+	negotiationRequestLength  = 41
+	negotiationResponseLength = 38
+	negotiationMACLength      = 16
+	negotiationHeaderLength   = 1
+	// length of the keys and tickets in requests, sealed messages have to
+	// fit into a dns name
+	negotiationKeyLength = 16
+
+	maxNegotiationAge = time.Second * 60
+	// how long a repeated request waits for the first one to be answered
+	repeatedNegotiationWait = time.Second * 5
+)
+
+// capabilities
+const (
+	capabilityStreams = 1 << iota
+	capabilityReverse
+	capabilityTun
+)
+
+type NegotiationRequest struct {
+	Version      byte
+	Method       byte
+	ClientPort   uint16
+	Token        []byte
+	Capabilities byte
+	Key          []byte
+	Timestamp    uint32
+	ClientIP     net.IP
+}
+
+type NegotiationResponse struct {
+	Version      byte
+	Status       uint16
+	ServerPort   uint16
+	Capabilities byte
+	Key          []byte
+	// the server's handle for the session, which is not sent to the client
+	Session string
+}
+
+func (r *NegotiationRequest) Encode() []byte {
+	b := []byte{r.Version, r.Method}
+	b = append(b, Uint16ToByteSlice(r.ClientPort)...)
+	b = append(b, r.Token...)
+	b = append(b, r.Capabilities)
+	b = append(b, r.Key...)
+	b = append(b, Uint32ToByteSlice(r.Timestamp)...)
+	if ip4 := r.ClientIP.To4(); ip4 != nil {
+		return append(b, ip4...)
+	}
+	return append(b, r.ClientIP...)
+}
+
+func DecodeNegotiationRequest(b []byte) (*NegotiationRequest, error) {
+	if len(b) < negotiationRequestLength {
+		return nil, errors.New("invalid negotiation request length")
+	}
+	r := &NegotiationRequest{Version: b[0], Method: b[1], ClientPort: ByteSliceToUint16(b[2:4]), Token: b[4:20], Capabilities: b[20], Key: b[21:37], Timestamp: ByteSliceToUint32(b[37:41])}
+	switch ip := b[negotiationRequestLength:]; len(ip) {
+	case 0:
+	case net.IPv4len, net.IPv6len:
+		r.ClientIP = net.IP(ip)
+	default:
+		return nil, errors.New("invalid negotiation request length")
+	}
+	if r.Version != negotiationVersion {
+		return nil, fmt.Errorf("unsupported negotiation version %d", r.Version)
+	}
+	return r, nil
+}
+
+func (r *NegotiationResponse) Encode() []byte {
+	b := []byte{r.Version}
+	b = append(b, Uint16ToByteSlice(r.Status)...)
+	b = append(b, Uint16ToByteSlice(r.ServerPort)...)
+	b = append(b, r.Capabilities)
+	key := make([]byte, 32)
+	copy(key, r.Key)
+	return append(b, key...)
+}
+
+func DecodeNegotiationResponse(b []byte) (*NegotiationResponse, error) {
+	if len(b) != negotiationResponseLength {
+		return nil, errors.New("invalid negotiation response length")
+	}
+	r := &NegotiationResponse{Version: b[0], Status: ByteSliceToUint16(b[1:3]), ServerPort: ByteSliceToUint16(b[3:5]), Capabilities: b[5], Key: b[6:38]}
+	if r.Version != negotiationVersion {
+		return nil, fmt.Errorf("unsupported negotiation version %d", r.Version)
+	}
+	return r, nil
+}
+
+// localCapabilities returns the features this side of the tunnel has
+// configured.
+func localCapabilities() byte {
+	capabilities := byte(capabilityStreams)
+	if len(config.ReverseServices) > 0 || len(config.ReversePorts) > 0 {
+		capabilities |= capabilityReverse
+	}
+	if config.Tun != nil {
+		capabilities |= capabilityTun
+	}
+	return capabilities
+}
+
+func sessionKey(clientKey, serverKey []byte) []byte {
+	sum := sha256.Sum256(append(append([]byte{}, clientKey...), serverKey...))
+	return sum[:]
+}
+
+// NegotiationRoute returns the method and id of a sealed request.
+func NegotiationRoute(message []byte) (byte, string, error) {
+	if len(message) < negotiationHeaderLength+32+negotiationMACLength {
+		return 0, "", errors.New("negotiation message too short")
+	}
+	return message[0], hex.EncodeToString(negotiationNonce(message)[:8]), nil
+}
+
+// negotiationNonce returns the ephemeral key of a sealed request, which is
+// unique to it.
+func negotiationNonce(message []byte) []byte {
+	return message[negotiationHeaderLength : negotiationHeaderLength+32]
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func negotiationCipher(shared, ephemeralPublicKey, serverPublicKey []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeralPublicKey)
+	h.Write(serverPublicKey)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var (
+	requestNonce  = make([]byte, 12)
+	responseNonce = append(make([]byte, 11), 1)
+)
+
+// SealNegotiationRequest encrypts request to serverPublicKey and returns the
+// message along with the cipher for opening the response. Every request uses
+// a new ephemeral key, so fixed nonces are fine.
+func SealNegotiationRequest(request *NegotiationRequest, serverPublicKey *ecdh.PublicKey) ([]byte, cipher.AEAD, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := ephemeral.ECDH(serverPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := negotiationCipher(shared, ephemeral.PublicKey().Bytes(), serverPublicKey.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	header := []byte{request.Method}
+	message := aead.Seal(append(append([]byte{}, header...), ephemeral.PublicKey().Bytes()...), requestNonce, request.Encode(), header)
+	return append(message, negotiationMAC(message)...), aead, nil
+}
+
+func negotiationMAC(message []byte) []byte {
+	h := hmac.New(sha256.New, []byte(config.Secret))
+	h.Write(message)
+	return h.Sum(nil)[:negotiationMACLength]
+}
+
+// VerifyNegotiationMAC reports whether message was signed with the secret.
+func VerifyNegotiationMAC(message []byte) bool {
+	if len(message) < negotiationMACLength {
+		return false
+	}
+	mac := message[len(message)-negotiationMACLength:]
+	return hmac.Equal(mac, negotiationMAC(message[:len(message)-negotiationMACLength]))
+}
+
+func OpenNegotiationResponse(message []byte, aead cipher.AEAD) (*NegotiationResponse, error) {
+	plaintext, err := aead.Open(nil, responseNonce, message, nil)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeNegotiationResponse(plaintext)
+}
+
+// OpenNegotiationRequest checks the hmac of a request sealed to privateKey,
+// decrypts it and returns it along with the cipher for sealing the response.
+func OpenNegotiationRequest(message []byte, privateKey *ecdh.PrivateKey) (*NegotiationRequest, cipher.AEAD, error) {
+	method, _, err := NegotiationRoute(message)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !VerifyNegotiationMAC(message) {
+		return nil, nil, errors.New("invalid hmac")
+	}
+	message = message[:len(message)-negotiationMACLength]
+	header, nonce := message[:negotiationHeaderLength], negotiationNonce(message)
+	ephemeralPublicKey, err := ecdh.X25519().NewPublicKey(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := privateKey.ECDH(ephemeralPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := negotiationCipher(shared, nonce, privateKey.PublicKey().Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := aead.Open(nil, requestNonce, message[negotiationHeaderLength+32:], header)
+	if err != nil {
+		return nil, nil, err
+	}
+	request, err := DecodeNegotiationRequest(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	if request.Method != method {
+		return nil, nil, errors.New("method does not match the request")
+	}
+	age := time.Since(time.Unix(int64(request.Timestamp), 0))
+	if age > maxNegotiationAge || age < -maxNegotiationAge {
+		return nil, nil, fmt.Errorf("timestamp is %s off", age.Round(time.Second))
+	}
+	return request, aead, nil
+}
+
+func SealNegotiationResponse(response *NegotiationResponse, aead cipher.AEAD) []byte {
+	return aead.Seal(nil, responseNonce, response.Encode(), nil)
+}
+
+// LoadPrivateKey reads the server's key from path, creating it first if it
+// does not exist.
+func LoadPrivateKey(path string) *ecdh.PrivateKey {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			log.Panic(err)
+		}
+		err = os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key.Bytes())+"\n"), 0600)
+		if err != nil {
+			log.Panic(err)
+		}
+		log.Printf("Created new private key in %s\n", path)
+		return key
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		log.Panicf("Invalid private key in %s\n", path)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(decoded)
+	if err != nil {
+		log.Panicf("Invalid private key in %s\n", path)
+	}
+	return key
+}
+
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(decoded)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testServerKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	config.Secret = "test secret"
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testNegotiationRequest(method byte, clientIP net.IP) *NegotiationRequest {
+	return &NegotiationRequest{
+		Version:      negotiationVersion,
+		Method:       method,
+		ClientPort:   40000,
+		Token:        randomBytes(16),
+		Capabilities: capabilityStreams,
+		Key:          randomBytes(negotiationKeyLength),
+		Timestamp:    uint32(time.Now().Unix()),
+		ClientIP:     clientIP,
+	}
+}
+
+func TestNegotiationRoundTrip(t *testing.T) {
+	serverKey := testServerKey(t)
+	tests := []struct {
+		name     string
+		request  *NegotiationRequest
+		clientIP net.IP
+	}{
+		{"allocate", testNegotiationRequest(negotiateAllocate, nil), nil},
+		{"punch with ipv4", testNegotiationRequest(negotiatePunch, net.ParseIP("192.0.2.1")), net.ParseIP("192.0.2.1")},
+		{"resume with ipv6", testNegotiationRequest(negotiateResume, net.ParseIP("2001:db8::1")), net.ParseIP("2001:db8::1")},
+		{"teardown", testNegotiationRequest(negotiateTearDown, nil), nil},
+	}
+	for _, test := range tests {
+		message, clientCipher, err := SealNegotiationRequest(test.request, serverKey.PublicKey())
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		method, id, err := NegotiationRoute(message)
+		if err != nil || method != test.request.Method || len(id) != 16 {
+			t.Errorf("%s: NegotiationRoute = %d, %q, %v", test.name, method, id, err)
+		}
+		request, serverCipher, err := OpenNegotiationRequest(message, serverKey)
+		if err != nil {
+			t.Errorf("%s: OpenNegotiationRequest failed: %s", test.name, err)
+			continue
+		}
+		if request.Method != test.request.Method || request.ClientPort != test.request.ClientPort || !bytes.Equal(request.Token, test.request.Token) || !bytes.Equal(request.Key, test.request.Key) || request.Timestamp != test.request.Timestamp {
+			t.Errorf("%s: opened %+v, want %+v", test.name, request, test.request)
+		}
+		if !request.ClientIP.Equal(test.clientIP) {
+			t.Errorf("%s: client ip %s, want %s", test.name, request.ClientIP, test.clientIP)
+		}
+
+		response := &NegotiationResponse{Version: negotiationVersion, Status: 200, ServerPort: 50000, Capabilities: capabilityTun, Key: randomBytes(32)}
+		opened, err := OpenNegotiationResponse(SealNegotiationResponse(response, serverCipher), clientCipher)
+		if err != nil {
+			t.Errorf("%s: OpenNegotiationResponse failed: %s", test.name, err)
+			continue
+		}
+		if opened.Status != response.Status || opened.ServerPort != response.ServerPort || opened.Capabilities != response.Capabilities || !bytes.Equal(opened.Key, response.Key) {
+			t.Errorf("%s: opened response %+v, want %+v", test.name, opened, response)
+		}
+	}
+}
+
+func TestNegotiationRouteIsNotReused(t *testing.T) {
+	serverKey := testServerKey(t)
+	request := testNegotiationRequest(negotiatePunch, nil)
+	first, _, _ := SealNegotiationRequest(request, serverKey.PublicKey())
+	second, _, _ := SealNegotiationRequest(request, serverKey.PublicKey())
+	_, firstID, _ := NegotiationRoute(first)
+	_, secondID, _ := NegotiationRoute(second)
+	if firstID == secondID {
+		t.Errorf("two requests of the same session share the id %s", firstID)
+	}
+}
+
+// resign replaces the hmac of message, as someone who knows the secret but
+// not the server's key could.
+func resign(message []byte) []byte {
+	message = message[:len(message)-negotiationMACLength]
+	return append(message, negotiationMAC(message)...)
+}
+
+func TestOpenTamperedNegotiationRequest(t *testing.T) {
+	serverKey := testServerKey(t)
+	otherKey := testServerKey(t)
+	message, _, err := SealNegotiationRequest(testNegotiationRequest(negotiatePunch, net.ParseIP("192.0.2.1")), serverKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	flip := func(i int) []byte {
+		tampered := append([]byte{}, message...)
+		tampered[i] ^= 1
+		return tampered
+	}
+	tests := []struct {
+		name    string
+		message []byte
+		key     *ecdh.PrivateKey
+	}{
+		{"method", flip(0), serverKey},
+		{"ephemeral key", flip(negotiationHeaderLength), serverKey},
+		{"ciphertext", flip(negotiationHeaderLength + 32), serverKey},
+		{"hmac", flip(len(message) - 1), serverKey},
+		{"resigned method", resign(flip(0)), serverKey},
+		{"resigned ciphertext", resign(flip(negotiationHeaderLength + 32)), serverKey},
+		{"truncated", message[:negotiationHeaderLength+32], serverKey},
+		{"other server", message, otherKey},
+	}
+	for _, test := range tests {
+		if _, _, err := OpenNegotiationRequest(test.message, test.key); err == nil {
+			t.Errorf("%s: tampered request was opened", test.name)
+		}
+	}
+}
+
+func TestDecodeNegotiationRequest(t *testing.T) {
+	encoded := testNegotiationRequest(negotiateAllocate, nil).Encode()
+	tests := []struct {
+		name string
+		b    []byte
+		ok   bool
+	}{
+		{"without client ip", encoded, true},
+		{"with ipv4", append(append([]byte{}, encoded...), 192, 0, 2, 1), true},
+		{"with ipv6", append(append([]byte{}, encoded...), net.ParseIP("2001:db8::1")...), true},
+		{"short", encoded[:negotiationRequestLength-1], false},
+		{"odd client ip", append(append([]byte{}, encoded...), 1, 2, 3), false},
+		{"old version", append([]byte{negotiationVersion - 1}, encoded[1:]...), false},
+	}
+	for _, test := range tests {
+		if _, err := DecodeNegotiationRequest(test.b); (err == nil) != test.ok {
+			t.Errorf("%s: DecodeNegotiationRequest returned %v", test.name, err)
+		}
+	}
+}
+
+// dnsTestCases pair a server with a client ip of the same family, as a
+// client reaches ipv6 servers over ipv6. The domains are the longest that fit.
+var dnsTestCases = []struct {
+	serverIP string
+	clientIP string
+	domain   string
+}{
+	{"192.0.2.1", "198.51.100.1", strings.Repeat("a", 66)},
+	{"2001:db8::2", "2001:db8::1", strings.Repeat("a", 26)},
+}
+
+func TestDNSMessageRoundTrip(t *testing.T) {
+	serverKey := testServerKey(t)
+	for _, test := range dnsTestCases {
+		message, _, err := SealNegotiationRequest(testNegotiationRequest(negotiatePunch, net.ParseIP(test.clientIP)), serverKey.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, domain := range []string{"t.example.com", test.domain} {
+			name, err := EncodeDNSMessage(message, test.serverIP, domain)
+			if err != nil {
+				t.Errorf("EncodeDNSMessage(%s, %s) failed: %s", test.serverIP, domain, err)
+				continue
+			}
+			decoded, serverIP, err := DecodeDNSMessage(strings.ToUpper(strings.TrimSuffix(name, "."+domain)))
+			if err != nil || !bytes.Equal(decoded, message) || !serverIP.Equal(net.ParseIP(test.serverIP)) {
+				t.Errorf("DecodeDNSMessage(%s) = %v, %s, %v", name, decoded, serverIP, err)
+			}
+		}
+	}
+}
+
+func TestEncodeDNSMessageTooLong(t *testing.T) {
+	serverKey := testServerKey(t)
+	for _, test := range dnsTestCases {
+		message, _, err := SealNegotiationRequest(testNegotiationRequest(negotiatePunch, net.ParseIP(test.clientIP)), serverKey.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name, err := EncodeDNSMessage(message, test.serverIP, test.domain+"a"); err == nil {
+			t.Errorf("EncodeDNSMessage(%s, %d character domain) = %d characters, want an error", test.serverIP, len(test.domain)+1, len(name))
+		}
+	}
+}
+
+func TestDecodeDNSMessageErrors(t *testing.T) {
+	for _, name := range []string{
+		"",
+		"aebagbaf",
+		"aebagbaf.not-base32",
+		"aebagbaf.aebag",
+		"!!.ma",
+	} {
+		if message, serverIP, err := DecodeDNSMessage(name); err == nil {
+			t.Errorf("DecodeDNSMessage(%q) = %v, %s, want an error", name, message, serverIP)
+		}
+	}
+}
+
+func TestOpenNegotiationRequestAge(t *testing.T) {
+	serverKey := testServerKey(t)
+	now := time.Now()
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		ok        bool
+	}{
+		{"now", now, true},
+		{"recent", now.Add(-maxNegotiationAge / 2), true},
+		{"slightly ahead", now.Add(maxNegotiationAge / 2), true},
+		{"stale", now.Add(-maxNegotiationAge - 2*time.Second), false},
+		{"too far ahead", now.Add(maxNegotiationAge + 2*time.Second), false},
+	}
+	for _, test := range tests {
+		request := testNegotiationRequest(negotiatePunch, nil)
+		request.Timestamp = uint32(test.timestamp.Unix())
+		message, _, err := SealNegotiationRequest(request, serverKey.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := OpenNegotiationRequest(message, serverKey); (err == nil) != test.ok {
+			t.Errorf("%s: OpenNegotiationRequest returned %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Negotiator relays negotiation messages from clients to servers, which is
+// what the cloudflare worker does:
+//
+//	HEAD /                     -> 200, used by clients as a health check
+//	POST / (NegotiatorRequest) -> the server's session api, see ServeControl
+//	POST /link/...             -> see PollNegotiator
+//
+// Messages are sealed to the server's key, so the negotiator only learns the
+// client's and the server's ips. The client ip is the address the request
+// came from, or the value of clientIPHeader when running behind a cdn or
+// reverse proxy. With dnsListenAddress set messages are also accepted as TXT
+// queries, see DNSSignaling.
+type Negotiator struct {
+	Client      *http.Client
+	RateLimiter *RateLimiter
+
+	Links                map[string]*ServerLink
+	LinkSecrets          map[string]string
+	PendingLinkResponses map[string]*PendingLinkResponse
+	LinkMutex            sync.Mutex
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (n *Negotiator) Start() {
+	n.Client = &http.Client{Timeout: time.Second * 5}
+	if config.ServerControl != nil {
+		tlsConfig, err := config.ServerControl.TLSConfig()
+		if err != nil {
+			log.Panicf("Invalid serverControl tls settings: %s\n", err)
+		}
+		n.Client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	n.Links = make(map[string]*ServerLink)
+	n.LinkSecrets = make(map[string]string)
+	for ip, secret := range config.LinkSecrets {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			log.Panicf("Invalid ip %s in linkSecrets\n", ip)
+		}
+		n.LinkSecrets[parsed.String()] = secret
+	}
+	n.PendingLinkResponses = make(map[string]*PendingLinkResponse)
+	if config.RateLimit > 0 {
+		n.RateLimiter = NewRateLimiter(config.RateLimit, config.RateLimitBurst)
+	}
+	if len(config.Servers) == 0 {
+		log.Println("No servers configured, relaying negotiation requests to any public server")
+	}
+
+	if config.DNSListenAddress != "" {
+		go n.ListenForDNS()
+	}
+
+	listenAddress := config.ListenAddress
+	if listenAddress == "" {
+		listenAddress = ":80"
+	}
+	server := &http.Server{
+		Addr:              listenAddress,
+		ReadHeaderTimeout: time.Second * 5,
+		ReadTimeout:       time.Second * 10,
+		WriteTimeout:      time.Second * 10,
+		IdleTimeout:       time.Second * 60,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w, Status: 200}
+			clientIP := n.ClientIP(r)
+			n.ServeHTTP(recorder, r, clientIP)
+			log.Printf("%s %s %s %d %s\n", clientIP, r.Method, r.URL.Path, recorder.Status, time.Since(start))
+		}),
+	}
+	log.Printf("Listening on %s for negotiation requests\n", listenAddress)
+	var err error
+	if config.CertFile != "" {
+		err = server.ListenAndServeTLS(config.CertFile, config.KeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (n *Negotiator) ClientIP(r *http.Request) string {
+	if config.ClientIPHeader != "" {
+		if ip := net.ParseIP(strings.TrimSpace(strings.Split(r.Header.Get(config.ClientIPHeader), ",")[0])); ip != nil {
+			return ip.String()
+		}
+	}
+	return getIPFromAddress(r.RemoteAddr)
+}
+
+// IsAllowedServer returns whether requests may be relayed to serverIP. Without
+// servers any public ip is allowed, but never the negotiator's own network:
+// loopback, private, link-local and other addresses that are not globally
+// routable.
+func (n *Negotiator) IsAllowedServer(serverIP string) bool {
+	if len(config.Servers) == 0 {
+		ip := net.ParseIP(serverIP)
+		return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate()
+	}
+	for _, server := range config.Servers {
+		if server == serverIP {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Negotiator) ServeHTTP(w http.ResponseWriter, r *http.Request, clientIP string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(200)
+		return
+	}
+	if n.IsLinkRequest(r) {
+		n.ServeLink(w, r, getIPFromAddress(r.RemoteAddr))
+		return
+	}
+	if !n.RateLimiter.Allow(clientIP) {
+		negotiatorMetrics.Add("rate_limited", 1)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request NegotiatorRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 2048)).Decode(&request); err != nil || request.Version != negotiationVersion {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	status, body := n.Relay(request.Server, clientIP, request.Message)
+	negotiatorMetrics.Add(fmt.Sprintf("status_%d", status), 1)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// Relay passes a negotiation message from the client at clientIP on to the
+// server and returns its response.
+func (n *Negotiator) Relay(serverIP, clientIP string, message []byte) (int, []byte) {
+	if net.ParseIP(serverIP) == nil || net.ParseIP(clientIP) == nil || len(message) == 0 {
+		return http.StatusBadRequest, nil
+	}
+	if !n.IsAllowedServer(serverIP) {
+		return http.StatusForbidden, nil
+	}
+	if link := n.LiveLink(serverIP); link != nil {
+		return n.RelayOverLink(link, clientIP, message)
+	}
+
+	method, id, err := NegotiationRoute(message)
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+	httpMethod, path := sessionRoute(method, id)
+	body, _ := json.Marshal(SessionRequest{ClientIP: clientIP, Message: message})
+	req, err := http.NewRequest(httpMethod, config.ServerControl.URL(serverIP, path), bytes.NewReader(body))
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := n.Client.Do(req)
+	if err != nil {
+		log.Printf("Failed to relay negotiation message to %s\n%s\n", serverIP, err)
+		return http.StatusBadGateway, nil
+	}
+	defer res.Body.Close()
+	// the sealed response carries the status for the client
+	var response SessionResponse
+	if json.NewDecoder(io.LimitReader(res.Body, 4096)).Decode(&response) == nil && response.Message != nil {
+		return http.StatusOK, response.Message
+	}
+	return res.StatusCode, nil
+}
+
+func (n *Negotiator) ListenForDNS() {
+	conn, err := net.ListenPacket("udp", config.DNSListenAddress)
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Printf("Listening on %s for dns negotiation requests for %s\n", config.DNSListenAddress, config.SignalingDomain)
+	buffer := make([]byte, 512)
+	for {
+		n2, address, err := conn.ReadFrom(buffer)
+		if err != nil {
+			log.Panic(err)
+		}
+		query := append([]byte{}, buffer[:n2]...)
+		go func() {
+			response := n.ServeDNS(query, getIPFromAddress(address.String()))
+			if response != nil {
+				conn.WriteTo(response, address)
+			}
+		}()
+	}
+}
+
+// ServeDNS answers a TXT query for <message>.<serverIP>.<domain>. The message
+// is relayed with the resolver's ip, the client's own is sealed inside it.
+func (n *Negotiator) ServeDNS(query []byte, resolverIP string) []byte {
+	q, err := ParseDNSQuestion(query)
+	if err != nil {
+		return nil
+	}
+	domain := strings.ToLower(strings.Trim(config.SignalingDomain, "."))
+	if !strings.HasSuffix(q.Name, "."+domain) {
+		return BuildDNSResponse(query, q, dnsRcodeRefused, "")
+	}
+	if q.Type != dnsTypeTXT {
+		return BuildDNSResponse(query, q, dnsRcodeNXDomain, "")
+	}
+	message, serverIP, err := DecodeDNSMessage(strings.TrimSuffix(q.Name, "."+domain))
+	if err != nil {
+		return BuildDNSResponse(query, q, dnsRcodeNXDomain, "")
+	}
+
+	start := time.Now()
+	var status int
+	var body []byte
+	if !n.RateLimiter.Allow(resolverIP) {
+		negotiatorMetrics.Add("rate_limited", 1)
+		status = http.StatusTooManyRequests
+	} else {
+		status, body = n.Relay(serverIP.String(), resolverIP, message)
+	}
+	negotiatorMetrics.Add(fmt.Sprintf("status_%d", status), 1)
+	log.Printf("%s POST %s (dns) %d %s\n", resolverIP, serverIP.String(), status, time.Since(start))
+	if status != 200 {
+		return BuildDNSResponse(query, q, dnsRcodeSuccess, fmt.Sprintf("error %d", status))
+	}
+	return BuildDNSResponse(query, q, dnsRcodeSuccess, base64.StdEncoding.EncodeToString(body))
+}
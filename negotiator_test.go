@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestIsAllowedServer(t *testing.T) {
+	defer func(servers []string) { config.Servers = servers }(config.Servers)
+	tests := []struct {
+		servers  []string
+		serverIP string
+		ok       bool
+	}{
+		{nil, "203.0.113.1", true},
+		{nil, "2001:db8::1", true},
+		{nil, "127.0.0.1", false},
+		{nil, "::1", false},
+		{nil, "10.0.0.1", false},
+		{nil, "192.168.1.1", false},
+		{nil, "fd00::1", false},
+		{nil, "169.254.169.254", false},
+		{nil, "fe80::1", false},
+		{nil, "0.0.0.0", false},
+		{nil, "224.0.0.1", false},
+		{nil, "not an ip", false},
+		{[]string{"10.0.0.1"}, "10.0.0.1", true},
+		{[]string{"10.0.0.1"}, "203.0.113.1", false},
+	}
+	n := &Negotiator{}
+	for _, test := range tests {
+		config.Servers = test.servers
+		if ok := n.IsAllowedServer(test.serverIP); ok != test.ok {
+			t.Errorf("IsAllowedServer(%s) with servers %v = %t, want %t", test.serverIP, test.servers, ok, test.ok)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	negotiatorProbeInterval = time.Minute * 5
+	negotiatorProbeTimeout  = time.Second * 5
+	// negotiators nobody has heard from yet are assumed to be this slow
+	defaultNegotiatorLatency = 1000.0
+)
+
+// NegotiatorStats is what the client remembers about a negotiator.
+type NegotiatorStats struct {
+	Name      string  `json:"name"`
+	Latency   float64 `json:"latency"` // moving average in milliseconds
+	Successes int     `json:"successes"`
+	Failures  int     `json:"failures"`
+
+	Config *NegotiatorConfig `json:"-"`
+}
+
+// Score is lower for negotiators that answer quickly and fail rarely.
+func (n *NegotiatorStats) Score() float64 {
+	return n.Latency * float64(n.Failures+1) / float64(n.Successes+1)
+}
+
+// NegotiatorPool ranks the configured negotiators by latency and history, so
+// negotiation goes to the best one and fails over to the rest. Stats are
+// saved to StateFile to survive restarts.
+type NegotiatorPool struct {
+	Negotiators []*NegotiatorStats
+	StateFile   string
+	LastProbe   time.Time
+	mu          sync.Mutex
+}
+
+func NewNegotiatorPool(negotiators []*NegotiatorConfig, stateFile string) *NegotiatorPool {
+	p := &NegotiatorPool{StateFile: stateFile}
+	saved := make(map[string]*NegotiatorStats)
+	if bytes, err := os.ReadFile(stateFile); err == nil {
+		var stats []*NegotiatorStats
+		if err = json.Unmarshal(bytes, &stats); err != nil {
+			log.Printf("Ignoring invalid negotiator state in %s\n%s\n", stateFile, err)
+		}
+		for _, n := range stats {
+			saved[n.Name] = n
+		}
+	}
+	for _, c := range negotiators {
+		n, ok := saved[c.String()]
+		if !ok {
+			n = &NegotiatorStats{Name: c.String(), Latency: defaultNegotiatorLatency}
+		}
+		n.Config = c
+		p.Negotiators = append(p.Negotiators, n)
+	}
+	return p
+}
+
+// Ranked returns the negotiators from best to worst.
+func (p *NegotiatorPool) Ranked() []*NegotiatorStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ranked := append([]*NegotiatorStats{}, p.Negotiators...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Score() < ranked[j].Score()
+	})
+	return ranked
+}
+
+// Record updates the stats of n after a request that took latency.
+func (p *NegotiatorPool) Record(n *NegotiatorStats, latency time.Duration, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ok {
+		n.Successes++
+		n.Latency = n.Latency*0.7 + float64(latency.Milliseconds())*0.3
+	} else {
+		n.Failures++
+	}
+	// old history counts less than recent history
+	if n.Successes+n.Failures > 100 {
+		n.Successes /= 2
+		n.Failures /= 2
+	}
+}
+
+// Probe sends a HEAD request to every negotiator at once, over the address
+// family of serverIP, and records how they did.
+func (p *NegotiatorPool) Probe(serverIP string) {
+	p.mu.Lock()
+	p.LastProbe = time.Now()
+	p.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, n := range p.Negotiators {
+		wg.Add(1)
+		go func(n *NegotiatorStats) {
+			defer wg.Done()
+			start := time.Now()
+			err := probeNegotiator(n.Config, serverIP)
+			if err != nil {
+				log.Printf("Negotiator %s failed health check\n%s\n", n.Name, err)
+			}
+			p.Record(n, time.Since(start), err == nil)
+		}(n)
+	}
+	wg.Wait()
+	p.Save()
+}
+
+func probeNegotiator(c *NegotiatorConfig, serverIP string) error {
+	req, err := c.NewRequest(http.MethodHead, serverIP, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: c.Client(serverIP).Transport, Timeout: negotiatorProbeTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("HEAD %s responded with status %d", req.URL, res.StatusCode)
+	}
+	return nil
+}
+
+// ShouldProbe reports whether the stats are old enough to probe again.
+func (p *NegotiatorPool) ShouldProbe() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.Negotiators) > 1 && time.Since(p.LastProbe) > negotiatorProbeInterval
+}
+
+func (p *NegotiatorPool) Save() {
+	if p.StateFile == "" {
+		return
+	}
+	p.mu.Lock()
+	bytes, err := json.MarshalIndent(p.Negotiators, "", "  ")
+	p.mu.Unlock()
+	if err != nil {
+		return
+	}
+	if err = os.WriteFile(p.StateFile, bytes, 0644); err != nil {
+		log.Printf("Failed to save negotiator state to %s\n%s\n", p.StateFile, err)
+	}
+}
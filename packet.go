@@ -1,12 +1,34 @@
 package main
 
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
 // flags:
 // 0 -> no flags
-// 1 -> dummy
+// 1 -> dummy (signed, see SignedPacket)
 // 2 -> keep-alive
 // 3 -> close connection
-// 4 -> destination port announcement
+// 4 -> destination announcement
 // 5 -> keep-alive response
+// 6 -> free id
+// 7 -> stream open (carries the destination)
+// 8 -> stream data
+// 9 -> stream ack
+// 10 -> stream fin
+// 11 -> stream reset
+// 12 -> ip packet (tun mode)
+// 13 -> reverse service registration
+// 14 -> address change (signed)
+// 15 -> path challenge (signed)
+// 16 -> path response (signed)
+// destinations in announcements are either a bare 2 byte port on the server
+// or an address type followed by the address and a 2 byte port:
+// 1 -> ipv4 (4 bytes)
+// 3 -> domain name (1 byte length + name)
+// 4 -> ipv6 (16 bytes)
 type Packet struct {
 	Payload []byte // max length : 1024*8 - 1 - 1 = 8190
 	ID      byte   // length : 1
@@ -43,3 +65,69 @@ func Uint16ToByteSlice(n uint16) []byte {
 	temp := []byte{}
 	return append(temp, byte(n), byte(n>>8))
 }
+
+func ByteSliceToUint32(byteSlice []byte) uint32 {
+	return uint32(byteSlice[0]) | uint32(byteSlice[1])<<8 | uint32(byteSlice[2])<<16 | uint32(byteSlice[3])<<24
+}
+
+func Uint32ToByteSlice(n uint32) []byte {
+	temp := []byte{}
+	return append(temp, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+}
+
+func EncodeDestination(address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("invalid host name %q", host)
+		}
+		b = append([]byte{3, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{1}, ip4...)
+	} else {
+		b = append([]byte{4}, ip.To16()...)
+	}
+	return append(b, Uint16ToByteSlice(uint16(port))...), nil
+}
+
+func DecodeDestination(b []byte) (string, error) {
+	if len(b) == 2 {
+		return fmt.Sprintf("0.0.0.0:%d", ByteSliceToUint16(b)), nil
+	}
+	if len(b) < 1 {
+		return "", fmt.Errorf("empty destination")
+	}
+	var host string
+	var rest []byte
+	switch b[0] {
+	case 1:
+		if len(b) < 1+4 {
+			return "", fmt.Errorf("short ipv4 destination")
+		}
+		host, rest = net.IP(b[1:5]).String(), b[5:]
+	case 3:
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return "", fmt.Errorf("short domain name destination")
+		}
+		host, rest = string(b[2:2+int(b[1])]), b[2+int(b[1]):]
+	case 4:
+		if len(b) < 1+16 {
+			return "", fmt.Errorf("short ipv6 destination")
+		}
+		host, rest = net.IP(b[1:17]).String(), b[17:]
+	default:
+		return "", fmt.Errorf("unknown destination address type %d", b[0])
+	}
+	if len(rest) != 2 {
+		return "", fmt.Errorf("invalid destination port")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(ByteSliceToUint16(rest)))), nil
+}
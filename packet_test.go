@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDestinationRoundTrip(t *testing.T) {
+	tests := []struct {
+		address string
+		encoded []byte
+		decoded string
+	}{
+		{"10.0.0.1:22", []byte{1, 10, 0, 0, 1, 22, 0}, "10.0.0.1:22"},
+		{"[::ffff:10.0.0.1]:22", []byte{1, 10, 0, 0, 1, 22, 0}, "10.0.0.1:22"},
+		{"[2001:db8::1]:443", append(append([]byte{4}, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1), 0xbb, 1), "[2001:db8::1]:443"},
+		{"example.com:80", append(append([]byte{3, 11}, "example.com"...), 80, 0), "example.com:80"},
+		{"localhost:65535", append(append([]byte{3, 9}, "localhost"...), 0xff, 0xff), "localhost:65535"},
+	}
+	for _, test := range tests {
+		encoded, err := EncodeDestination(test.address)
+		if err != nil {
+			t.Errorf("EncodeDestination(%q) failed: %s", test.address, err)
+			continue
+		}
+		if !bytes.Equal(encoded, test.encoded) {
+			t.Errorf("EncodeDestination(%q) = %v, want %v", test.address, encoded, test.encoded)
+		}
+		decoded, err := DecodeDestination(encoded)
+		if err != nil || decoded != test.decoded {
+			t.Errorf("DecodeDestination(%v) = %q, %v, want %q", encoded, decoded, err, test.decoded)
+		}
+	}
+}
+
+func TestEncodeDestinationErrors(t *testing.T) {
+	for _, address := range []string{
+		"10.0.0.1",
+		"10.0.0.1:65536",
+		"10.0.0.1:port",
+		":80",
+		strings.Repeat("a", 256) + ":80",
+	} {
+		if encoded, err := EncodeDestination(address); err == nil {
+			t.Errorf("EncodeDestination(%q) = %v, want an error", address, encoded)
+		}
+	}
+}
+
+func TestDecodeDestination(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		decoded string
+		ok      bool
+	}{
+		{"port only", []byte{22, 0}, "0.0.0.0:22", true},
+		{"empty", nil, "", false},
+		{"short ipv4", []byte{1, 10, 0, 0}, "", false},
+		{"short ipv6", []byte{4, 0x20, 0x01}, "", false},
+		{"short name", []byte{3, 11, 'e', 'x'}, "", false},
+		{"name without length", []byte{3}, "", false},
+		{"missing port", []byte{1, 10, 0, 0, 1}, "", false},
+		{"long port", []byte{1, 10, 0, 0, 1, 22, 0, 0}, "", false},
+		{"unknown type", []byte{2, 10, 0, 0, 1, 22, 0}, "", false},
+	}
+	for _, test := range tests {
+		decoded, err := DecodeDestination(test.b)
+		if (err == nil) != test.ok || decoded != test.decoded {
+			t.Errorf("%s: DecodeDestination(%v) = %q, %v", test.name, test.b, decoded, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter keeps a token bucket per key, for example per source ip.
+// Buckets that have refilled completely are forgotten to bound memory.
+type RateLimiter struct {
+	Rate    float64 // tokens per second
+	Burst   float64
+	buckets map[string]*tokenBucket
+	mu      sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(perMinute, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &RateLimiter{Rate: float64(perMinute) / 60, Burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		for now := range ticker.C {
+			l.mu.Lock()
+			for key, b := range l.buckets {
+				if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= l.Burst {
+					delete(l.buckets, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+	return l
+}
+
+// Allow takes a token from the bucket of key and reports whether there was
+// one. A nil limiter allows everything.
+func (l *RateLimiter) Allow(key string) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.Burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if b.tokens > l.Burst {
+		b.tokens = l.Burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RateLimitConfig sets token bucket limits in requests per minute for each
+// source ip and for all sources together. Zero keeps the default and a
+// negative value turns the limit off.
+type RateLimitConfig struct {
+	PerSource      int `json:"perSource"`
+	PerSourceBurst int `json:"perSourceBurst"`
+	Global         int `json:"global"`
+	GlobalBurst    int `json:"globalBurst"`
+}
+
+// SourceRateLimiter limits requests per source and globally.
+type SourceRateLimiter struct {
+	Source *RateLimiter
+	Global *RateLimiter
+}
+
+func NewSourceRateLimiter(c *RateLimitConfig, defaults RateLimitConfig) *SourceRateLimiter {
+	if c != nil {
+		for _, pair := range [][2]*int{{&defaults.PerSource, &c.PerSource}, {&defaults.PerSourceBurst, &c.PerSourceBurst}, {&defaults.Global, &c.Global}, {&defaults.GlobalBurst, &c.GlobalBurst}} {
+			if *pair[1] != 0 {
+				*pair[0] = *pair[1]
+			}
+		}
+	}
+	l := &SourceRateLimiter{}
+	if defaults.PerSource > 0 {
+		l.Source = NewRateLimiter(defaults.PerSource, defaults.PerSourceBurst)
+	}
+	if defaults.Global > 0 {
+		l.Global = NewRateLimiter(defaults.Global, defaults.GlobalBurst)
+	}
+	return l
+}
+
+// Allow takes a token for source and returns which limit was hit, "source"
+// or "global", or "" if the request is allowed.
+func (l *SourceRateLimiter) Allow(source string) string {
+	if !l.Source.Allow(source) {
+		return "source"
+	}
+	if !l.Global.Allow("") {
+		return "global"
+	}
+	return ""
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(60, 3)
+	for i := 0; i < 3; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("request %d within the burst was limited", i+1)
+		}
+	}
+	if l.Allow("a") {
+		t.Error("request after the burst was allowed")
+	}
+	if !l.Allow("b") {
+		t.Error("another key shares the bucket")
+	}
+
+	// a second later one token has refilled
+	l.mu.Lock()
+	l.buckets["a"].last = l.buckets["a"].last.Add(-time.Second)
+	l.mu.Unlock()
+	if !l.Allow("a") {
+		t.Error("refilled token was not allowed")
+	}
+	if l.Allow("a") {
+		t.Error("more than the refilled token was allowed")
+	}
+	if !(*RateLimiter)(nil).Allow("a") {
+		t.Error("nil limiter limited")
+	}
+}
+
+func TestSourceRateLimiter(t *testing.T) {
+	l := NewSourceRateLimiter(&RateLimitConfig{PerSource: 60, PerSourceBurst: 2, Global: 60, GlobalBurst: 3}, RateLimitConfig{PerSource: 10, PerSourceBurst: 5, Global: 600, GlobalBurst: 60})
+	for _, test := range []struct {
+		source string
+		limit  string
+	}{
+		{"192.0.2.1", ""},
+		{"192.0.2.1", ""},
+		{"192.0.2.1", "source"},
+		{"192.0.2.2", ""},
+		{"192.0.2.3", "global"},
+	} {
+		if limit := l.Allow(test.source); limit != test.limit {
+			t.Errorf("request from %s hit %q, want %q", test.source, limit, test.limit)
+		}
+	}
+
+	unlimited := NewSourceRateLimiter(&RateLimitConfig{PerSource: -1, Global: -1}, RateLimitConfig{PerSource: 10, PerSourceBurst: 5, Global: 600, GlobalBurst: 60})
+	for i := 0; i < 100; i++ {
+		if limit := unlimited.Allow("192.0.2.1"); limit != "" {
+			t.Fatalf("disabled limits hit %q", limit)
+		}
+	}
+}
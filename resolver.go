@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const resolverTimeout = time.Second * 5
+
+// ResolverConfig is a dns server used for looking up negotiators and
+// servers. The url picks the protocol:
+//
+//	1.1.1.1 or udp://1.1.1.1:53     plain dns
+//	tls://dns.google                dns over tls (rfc 7858), port 853 by default
+//	https://dns.google/dns-query    dns over https (rfc 8484)
+//
+// Bootstrap holds ips to connect to instead of looking up the host of tls
+// and https resolvers, which would otherwise go through the system
+// resolver. In config files a resolver can also be given as just its url.
+type ResolverConfig struct {
+	URL       string   `json:"url"`
+	Bootstrap []string `json:"bootstrap"`
+
+	client *http.Client
+	mu     sync.Mutex
+}
+
+func (r *ResolverConfig) UnmarshalJSON(data []byte) error {
+	var u string
+	if json.Unmarshal(data, &u) == nil {
+		r.URL = u
+		return nil
+	}
+	type plain ResolverConfig
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// parse returns the protocol, host and port of the resolver.
+func (r *ResolverConfig) parse() (string, string, string, error) {
+	if !strings.Contains(r.URL, "://") {
+		if net.ParseIP(r.URL) != nil {
+			return "udp", r.URL, "53", nil
+		}
+		host, port, err := net.SplitHostPort(r.URL)
+		return "udp", host, port, err
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return "", "", "", err
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "udp":
+		if port == "" {
+			port = "53"
+		}
+	case "tls":
+		if port == "" {
+			port = "853"
+		}
+	case "https":
+		if port == "" {
+			port = "443"
+		}
+	default:
+		return "", "", "", fmt.Errorf("unknown resolver scheme %s", u.Scheme)
+	}
+	return u.Scheme, u.Hostname(), port, nil
+}
+
+// dial connects to the resolver at host:port, using a bootstrap ip if there
+// are any.
+func (r *ResolverConfig) dial(ctx context.Context, host, port string) (net.Conn, error) {
+	d := net.Dialer{Timeout: resolverTimeout}
+	if len(r.Bootstrap) == 0 {
+		return d.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	}
+	var err error
+	for _, ip := range r.Bootstrap {
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// Exchange sends a dns query to the resolver and returns the answer.
+func (r *ResolverConfig) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	protocol, host, port, err := r.parse()
+	if err != nil {
+		return nil, err
+	}
+	switch protocol {
+	case "udp":
+		conn, err := (&net.Dialer{Timeout: resolverTimeout}).DialContext(ctx, "udp", net.JoinHostPort(host, port))
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+		buffer := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				return nil, err
+			}
+			// skip answers to other queries
+			if n >= 2 && bytes.Equal(buffer[:2], query[:2]) {
+				return buffer[:n], nil
+			}
+		}
+	case "tls":
+		rawConn, err := r.dial(ctx, host, port)
+		if err != nil {
+			return nil, err
+		}
+		conn := tls.Client(rawConn, &tls.Config{ServerName: host})
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		if _, err = conn.Write(append(framed, query...)); err != nil {
+			return nil, err
+		}
+		length := make([]byte, 2)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		answer := make([]byte, binary.BigEndian.Uint16(length))
+		_, err = io.ReadFull(conn, answer)
+		return answer, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	res, err := r.httpClient(host, port).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("%s responded with status %d", r.URL, res.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, 65535))
+}
+
+func (r *ResolverConfig) httpClient(host, port string) *http.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.client == nil {
+		r.client = &http.Client{
+			Timeout: resolverTimeout,
+			Transport: &http.Transport{
+				ForceAttemptHTTP2: true,
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return r.dial(ctx, host, port)
+				},
+			},
+		}
+	}
+	return r.client
+}
+
+// resolverConn lets the go resolver talk to a list of resolvers. The go
+// resolver frames queries like dns over tcp on connections that are not
+// packet connections, so each query written is sent to the resolvers in
+// order until one of them answers, and the answer is framed the same way
+// for reading.
+type resolverConn struct {
+	Resolvers []*ResolverConfig
+	written   []byte
+	answers   bytes.Buffer
+	deadline  time.Time
+}
+
+func (c *resolverConn) Write(b []byte) (int, error) {
+	c.written = append(c.written, b...)
+	for len(c.written) >= 2 {
+		length := int(binary.BigEndian.Uint16(c.written))
+		if len(c.written) < 2+length {
+			break
+		}
+		query := c.written[2 : 2+length]
+		c.written = c.written[2+length:]
+		answer, err := c.exchange(query)
+		if err != nil {
+			return 0, err
+		}
+		c.answers.Write(binary.BigEndian.AppendUint16(nil, uint16(len(answer))))
+		c.answers.Write(answer)
+	}
+	return len(b), nil
+}
+
+func (c *resolverConn) exchange(query []byte) ([]byte, error) {
+	deadline := c.deadline
+	if deadline.IsZero() {
+		deadline = time.Now().Add(resolverTimeout * 2)
+	}
+	var err error
+	for _, r := range c.Resolvers {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		var answer []byte
+		answer, err = r.Exchange(ctx, query)
+		cancel()
+		if err == nil {
+			return answer, nil
+		}
+		log.Printf("Resolver %s failed\n%s\n", r.URL, err)
+	}
+	if err == nil {
+		err = errors.New("no resolvers")
+	}
+	return nil, err
+}
+
+func (c *resolverConn) Read(b []byte) (int, error) {
+	if c.answers.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.answers.Read(b)
+}
+
+func (c *resolverConn) Close() error                       { return nil }
+func (c *resolverConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *resolverConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *resolverConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *resolverConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *resolverConn) SetWriteDeadline(t time.Time) error { c.deadline = t; return nil }
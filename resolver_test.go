@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// listenTestDNS returns the address of a udp dns server on 127.0.0.1 that
+// answers queries with serve.
+func listenTestDNS(t *testing.T, serve func(query []byte) []byte) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			if answer := serve(append([]byte{}, buffer[:n]...)); answer != nil {
+				conn.WriteToUDP(answer, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// answerTestTXT answers every TXT query with txt.
+func answerTestTXT(txt string) func([]byte) []byte {
+	return func(query []byte) []byte {
+		q, err := ParseDNSQuestion(query)
+		if err != nil {
+			return nil
+		}
+		if q.Type != dnsTypeTXT {
+			return BuildDNSResponse(query, q, dnsRcodeNXDomain, "")
+		}
+		return BuildDNSResponse(query, q, dnsRcodeSuccess, txt)
+	}
+}
+
+// testResolver returns a go resolver that goes through resolvers.
+func testResolver(resolvers ...*ResolverConfig) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &resolverConn{Resolvers: resolvers}, nil
+		},
+	}
+}
+
+func TestResolverConn(t *testing.T) {
+	// nothing listens on the port of a closed socket
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := closed.LocalAddr().String()
+	closed.Close()
+	first := listenTestDNS(t, answerTestTXT("first"))
+	second := listenTestDNS(t, answerTestTXT("second"))
+
+	tests := []struct {
+		name      string
+		resolvers []string
+		answer    string
+	}{
+		{"first resolver", []string{first, second}, "first"},
+		{"fallback", []string{down, second}, "second"},
+		{"bare address", []string{"udp://" + first}, "first"},
+		{"all down", []string{down}, ""},
+	}
+	for _, test := range tests {
+		var resolvers []*ResolverConfig
+		for _, address := range test.resolvers {
+			resolvers = append(resolvers, &ResolverConfig{URL: address})
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		records, err := testResolver(resolvers...).LookupTXT(ctx, "test.example.com")
+		cancel()
+		if test.answer == "" {
+			if err == nil {
+				t.Errorf("%s: LookupTXT = %v, want an error", test.name, records)
+			}
+			continue
+		}
+		if err != nil || len(records) != 1 || records[0] != test.answer {
+			t.Errorf("%s: LookupTXT = %v, %v, want %s", test.name, records, err, test.answer)
+		}
+	}
+}
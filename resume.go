@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A client that lost its tunnel first tries to resume its session instead of
+// negotiating a new one, so the server keeps its flow ids, destination
+// announcements, streams, reverse services and keys. The resume request is
+// sent from a new port with the session's token and its ticket in place of
+// the key. The first ticket is derived from the session key, and every
+// resume answers with the next one in the key field, so a ticket can only be
+// used once. The session then becomes ready again with a dummy packet like a
+// new one. Packets that either side sends while the session is not ready are
+// buffered, up to resumeBufferSize bytes for resumeBufferTime, and sent once
+// it is.
+const (
+	resumeBufferSize = 256 * 1024
+	resumeBufferTime = time.Second * 10
+)
+
+// sessionTicket returns the first ticket of the session with key.
+func sessionTicket(key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("ticket"))
+	return h.Sum(nil)[:negotiationKeyLength]
+}
+
+type bufferedPacket struct {
+	b    []byte
+	time time.Time
+}
+
+// PacketBuffer holds packets sent while a session is not ready.
+type PacketBuffer struct {
+	packets []bufferedPacket
+	size    int
+	mu      sync.Mutex
+}
+
+// Add buffers a copy of b, dropping it if the buffer is full.
+func (p *PacketBuffer) Add(b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.size+len(b) > resumeBufferSize {
+		return
+	}
+	p.packets = append(p.packets, bufferedPacket{b: append([]byte{}, b...), time: time.Now()})
+	p.size += len(b)
+}
+
+// Flush writes the buffered packets that are not older than resumeBufferTime
+// with write, in the order they were added, and returns how many it wrote.
+func (p *PacketBuffer) Flush(write func([]byte) error) int {
+	p.mu.Lock()
+	packets := p.packets
+	p.packets, p.size = nil, 0
+	p.mu.Unlock()
+	sent := 0
+	for _, packet := range packets {
+		if time.Since(packet.time) > resumeBufferTime {
+			continue
+		}
+		if write(packet.b) != nil {
+			break
+		}
+		sent++
+	}
+	return sent
+}
+
+func (p *PacketBuffer) Reset() {
+	p.mu.Lock()
+	p.packets, p.size = nil, 0
+	p.mu.Unlock()
+}
+
+// Send writes b to the client, or buffers it while the session is not ready.
+func (u *User) Send(b []byte) error {
+	if !u.Ready || u.ActualAddress == nil {
+		u.Buffer.Add(b)
+		return nil
+	}
+	_, err := u.Connection.WriteToUDP(b, u.ActualAddress)
+	return err
+}
+
+// ResumeSession moves the session with token to clientIPAndPort if ticket is
+// its current one, and returns it with its next ticket. The caller holds
+// s.ConnectionsMutex.
+func (s *Server) ResumeSession(clientIPAndPort string, token, ticket []byte) (*User, int) {
+	var user *User
+	var oldClientIPAndPort string
+	for address, u := range s.ServerToClientConnections {
+		if hmac.Equal(u.Token, token) && !u.ShouldClose {
+			user, oldClientIPAndPort = u, address
+			break
+		}
+	}
+	if user == nil {
+		return nil, 404
+	}
+	if !hmac.Equal(user.Ticket, ticket) {
+		return nil, 403
+	}
+	if other, ok := s.ServerToClientConnections[clientIPAndPort]; ok && other != user {
+		return nil, 409
+	}
+	log.Printf("Resuming session of %s from %s\n", oldClientIPAndPort, clientIPAndPort)
+	negotiationMetrics.Add("resumed", 1)
+	user.Ready = false
+	user.PendingAddress = nil
+	user.PathChallenge = nil
+	user.ActualAddress = nil
+	user.LastReceivedPacketTime = time.Now().Unix()
+	user.Ticket = randomBytes(negotiationKeyLength)
+	delete(s.ServerToClientConnections, oldClientIPAndPort)
+	user.NegotiatedAddress = clientIPAndPort
+	s.ServerToClientConnections[clientIPAndPort] = user
+	return user, 200
+}
+
+// Send writes b to the server, or buffers it while the tunnel is down.
+func (c *Client) Send(b []byte) error {
+	if !c.Ready {
+		c.Buffer.Add(b)
+		return nil
+	}
+	_, err := c.ConnectionToServer.Write(b)
+	return err
+}
+
+// Resume picks the session up again from a new port after the tunnel to the
+// server was lost, and reports whether the server still had it.
+func (c *Client) Resume() (resumed bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("Failed to resume session with %s\n%v\n", c.ServerIP, e)
+		}
+	}()
+	if c.Ticket == nil {
+		return false
+	}
+	port := c.SelectPort(c.ServerIP)
+	response := c.Negotiate(c.ServerIP, &NegotiationRequest{Version: negotiationVersion, Method: negotiateResume, ClientPort: portNumber(port), Token: c.Token, Capabilities: localCapabilities(), Key: c.Ticket})
+	c.Ticket = response.Key[:negotiationKeyLength]
+	c.Port = port
+	c.ServerPort = strconv.Itoa(int(response.ServerPort))
+	conn := c.Punch(c.ServerIP, c.Port, c.ServerPort, c.Token, c.SessionKey)
+	c.ConnectionToServer.Close()
+	c.ConnectionToServer = conn
+	log.Printf("Resumed session with %s from port %s\n", net.JoinHostPort(c.ServerIP, c.ServerPort), c.Port)
+	return true
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// Reverse services are listened on by the server and dialed by the client.
+// The client registers them with flag 13 and the server only opens ports
+// listed in its reversePorts. Flows started by the server use ids 128-255 so
+// they never collide with ids assigned by the client.
+const (
+	reverseProtocolTCP = 6
+	reverseProtocolUDP = 17
+	firstReverseID     = 128
+)
+
+func reverseServiceProtocol(protocol string) byte {
+	if protocol == "tcp" {
+		return reverseProtocolTCP
+	}
+	return reverseProtocolUDP
+}
+
+// SendReverseServiceRegistrations asks the server to listen for the reverse
+// services. Registrations are idempotent, so they are repeated with every
+// keep-alive response in case one gets lost.
+func (c *Client) SendReverseServiceRegistrations() {
+	for _, service := range config.ReverseServices {
+		registration := []byte{13, 0, reverseServiceProtocol(service.Protocol)}
+		registration = append(registration, Uint16ToByteSlice(service.Port)...)
+		_, err := c.ConnectionToServer.Write(registration)
+		if err != nil {
+			log.Printf("Error sending reverse service registration to server\n%s\n", err)
+		}
+	}
+}
+
+func (c *Client) FindReverseService(protocol string, port uint16) (Service, bool) {
+	for _, service := range config.ReverseServices {
+		if service.Protocol == protocol && service.Port == port {
+			return service, true
+		}
+	}
+	return Service{}, false
+}
+
+// DialReverseService opens the client side of a stream started by the server.
+func (c *Client) DialReverseService(destination []byte) (net.Conn, error) {
+	if len(destination) != 2 {
+		return nil, fmt.Errorf("invalid reverse service announcement")
+	}
+	service, ok := c.FindReverseService("tcp", ByteSliceToUint16(destination))
+	if !ok {
+		return nil, fmt.Errorf("no reverse tcp service for port %d", ByteSliceToUint16(destination))
+	}
+	return net.DialTimeout("tcp", service.Destination, streamDialTimeout)
+}
+
+// OpenReverseUDPFlow dials the client side destination of a udp flow started
+// by the server and relays its replies back.
+func (c *Client) OpenReverseUDPFlow(id byte, announcement []byte) {
+	if len(announcement) != 2 {
+		return
+	}
+	service, ok := c.FindReverseService("udp", ByteSliceToUint16(announcement))
+	if !ok {
+		log.Printf("Received announcement for unknown reverse udp service on port %d\n", ByteSliceToUint16(announcement))
+		return
+	}
+	c.CloseReverseUDPFlow(id)
+	address, err := net.ResolveUDPAddr("udp", service.Destination)
+	if err != nil {
+		log.Printf("Failed to resolve reverse service at %s\n%s\n", service.Destination, err)
+		return
+	}
+	conn, err := net.DialUDP("udp", nil, address)
+	if err != nil {
+		log.Printf("Failed to dial reverse service at %s\n%s\n", service.Destination, err)
+		return
+	}
+	c.ReverseMutex.Lock()
+	if old, ok := c.ReverseConnections[id]; ok {
+		old.Close()
+	}
+	c.ReverseConnections[id] = conn
+	c.ReverseMutex.Unlock()
+	log.Printf("Created new connection to reverse service at %s for packets with id %d\n", service.Destination, id)
+
+	go func() {
+		packet := createPacket()
+		packet.ID = id
+		buffer := make([]byte, (1024*8)-2)
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				return
+			}
+			packet.Payload = buffer[:n]
+			if err = c.Send(packet.EncodePacket()); err != nil {
+				log.Printf("Error writing reverse service packet to server\n%s\n", err)
+			}
+		}
+	}()
+}
+
+func (c *Client) CloseReverseUDPFlow(id byte) {
+	c.ReverseMutex.Lock()
+	defer c.ReverseMutex.Unlock()
+	if conn, ok := c.ReverseConnections[id]; ok {
+		conn.Close()
+		delete(c.ReverseConnections, id)
+	}
+}
+
+// CloseReverseUDPFlows closes every udp flow started by the server.
+func (c *Client) CloseReverseUDPFlows() {
+	c.ReverseMutex.Lock()
+	defer c.ReverseMutex.Unlock()
+	for id, conn := range c.ReverseConnections {
+		conn.Close()
+		delete(c.ReverseConnections, id)
+	}
+}
+
+func isAllowedReversePort(port uint16) bool {
+	for _, p := range config.ReversePorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterReverseService opens a listener for a reverse service requested by
+// user. Listeners belong to the user and are closed with its connection.
+func (s *Server) RegisterReverseService(user *User, registration []byte) {
+	if len(registration) != 3 || !user.Ready {
+		return
+	}
+	protocol, port := registration[0], ByteSliceToUint16(registration[1:])
+	key := fmt.Sprintf("%d/%d", protocol, port)
+	user.ReverseMutex.Lock()
+	_, ok := user.ReverseListeners[key]
+	user.ReverseMutex.Unlock()
+	if ok {
+		return
+	}
+	if !isAllowedReversePort(port) {
+		log.Printf("Refused reverse service on port %d for client at %s\n", port, user.ActualAddress.String())
+		user.ReverseMutex.Lock()
+		user.ReverseListeners[key] = nil
+		user.ReverseMutex.Unlock()
+		return
+	}
+
+	var err error
+	switch protocol {
+	case reverseProtocolTCP:
+		var listener *net.TCPListener
+		listener, err = net.ListenTCP("tcp", &net.TCPAddr{Port: int(port)})
+		if err == nil {
+			user.ReverseMutex.Lock()
+			user.ReverseListeners[key] = listener
+			user.ReverseMutex.Unlock()
+			go s.AcceptReverseTCP(user, listener, port)
+		}
+	case reverseProtocolUDP:
+		var listener *net.UDPConn
+		listener, err = net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+		if err == nil {
+			user.ReverseMutex.Lock()
+			user.ReverseListeners[key] = listener
+			user.ReverseMutex.Unlock()
+			go s.ReadReverseUDP(user, listener, port)
+		}
+	default:
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to listen for reverse service on port %d for client at %s\n%s\n", port, user.ActualAddress.String(), err)
+		user.ReverseMutex.Lock()
+		user.ReverseListeners[key] = nil
+		user.ReverseMutex.Unlock()
+		return
+	}
+	log.Printf("Listening on port %d for reverse service of client at %s\n", port, user.ActualAddress.String())
+}
+
+// AssignReverseID returns a free id for a flow started by the server, or
+// false if all of them are in use.
+func (s *Server) AssignReverseID(user *User) (byte, bool) {
+	user.ReverseMutex.Lock()
+	defer user.ReverseMutex.Unlock()
+	for id := firstReverseID; id < 256; id++ {
+		if _, ok := user.ReverseUDPAddresses[byte(id)]; !ok && !user.Streams.Has(byte(id)) {
+			return byte(id), true
+		}
+	}
+	return 0, false
+}
+
+func (s *Server) AcceptReverseTCP(user *User, listener *net.TCPListener, port uint16) {
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		id, ok := s.AssignReverseID(user)
+		if !ok || user.ShouldClose {
+			conn.Close()
+			continue
+		}
+		if user.Streams.Open(id, conn, Uint16ToByteSlice(port), nil) != nil {
+			conn.Close()
+			continue
+		}
+		log.Printf("Accepted reverse tcp connection from %s on port %d with id of %d\n", conn.RemoteAddr().String(), port, id)
+	}
+}
+
+func (s *Server) ReadReverseUDP(user *User, listener *net.UDPConn, port uint16) {
+	packet := createPacket()
+	buffer := make([]byte, (1024*8)-2)
+	for {
+		n, remoteAddress, err := listener.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if user.ShouldClose {
+			continue
+		}
+		user.ReverseMutex.Lock()
+		id, ok := user.ReverseUDPIDs[remoteAddress.String()]
+		user.ReverseMutex.Unlock()
+		if !ok {
+			id, ok = s.AssignReverseID(user)
+			if !ok {
+				continue
+			}
+			user.ReverseMutex.Lock()
+			user.ReverseUDPIDs[remoteAddress.String()] = id
+			user.ReverseUDPAddresses[id] = remoteAddress
+			user.ReverseUDPListeners[id] = listener
+			user.ReverseMutex.Unlock()
+			log.Printf("Received packet from new user at %s on reverse service port %d with id of %d\n", remoteAddress.String(), port, id)
+			announcement := append([]byte{4, id}, Uint16ToByteSlice(port)...)
+			user.Send(announcement)
+		}
+		user.ReverseMutex.Lock()
+		user.ReverseUDPLastPacketTime[id] = time.Now().Unix()
+		user.ReverseMutex.Unlock()
+		packet.ID = id
+		packet.Payload = buffer[:n]
+		if err = user.Send(packet.EncodePacket()); err != nil {
+			log.Printf("Error writing reverse service packet to client at %s\n%s\n", user.ActualAddress.String(), err)
+		}
+	}
+}
+
+// WriteReverseUDPPacket passes a reply from the client to the user of a
+// reverse udp service.
+func (s *Server) WriteReverseUDPPacket(user *User, packet *Packet) {
+	user.ReverseMutex.Lock()
+	listener, ok := user.ReverseUDPListeners[packet.ID]
+	address := user.ReverseUDPAddresses[packet.ID]
+	if ok {
+		user.ReverseUDPLastPacketTime[packet.ID] = time.Now().Unix()
+	}
+	user.ReverseMutex.Unlock()
+	if !ok {
+		return
+	}
+	if _, err := listener.WriteToUDP(packet.Payload, address); err != nil {
+		log.Printf("Error writing reverse service packet to %s\n%s\n", address.String(), err)
+	}
+}
+
+// FreeIdleReverseUDPFlows forgets reverse udp flows that have been idle for
+// longer than timeout seconds and tells the client to close them.
+func (s *Server) FreeIdleReverseUDPFlows(user *User, timeout int64) {
+	user.ReverseMutex.Lock()
+	defer user.ReverseMutex.Unlock()
+	for id, lastPacketTime := range user.ReverseUDPLastPacketTime {
+		if time.Now().Unix()-lastPacketTime <= timeout {
+			continue
+		}
+		delete(user.ReverseUDPIDs, user.ReverseUDPAddresses[id].String())
+		delete(user.ReverseUDPAddresses, id)
+		delete(user.ReverseUDPListeners, id)
+		delete(user.ReverseUDPLastPacketTime, id)
+		user.Connection.WriteToUDP([]byte{6, id}, user.ActualAddress)
+	}
+}
+
+func (s *Server) CloseReverseServices(user *User) {
+	user.ReverseMutex.Lock()
+	defer user.ReverseMutex.Unlock()
+	for key, listener := range user.ReverseListeners {
+		if listener != nil {
+			listener.Close()
+		}
+		delete(user.ReverseListeners, key)
+	}
+}
@@ -0,0 +1,70 @@
+#!/bin/bash
+# Runs a server and a client in tun mode inside two network namespaces and
+# pings the server's tun address from the client. The built-in negotiator
+# runs next to the server.
+# usage: sudo ./tun-netns-test.sh
+
+set -e
+BINARY=$(realpath "$(dirname "$0")/../sneaky-tunnel")
+DIR=$(mktemp -d)
+
+cleanup() {
+    ip netns pids st-client 2>/dev/null | xargs -r kill
+    ip netns pids st-server 2>/dev/null | xargs -r kill
+    ip netns del st-client 2>/dev/null || true
+    ip netns del st-server 2>/dev/null || true
+    rm -rf "$DIR"
+}
+trap cleanup EXIT
+
+ip netns add st-client
+ip netns add st-server
+ip link add st-veth0 netns st-client type veth peer name st-veth1 netns st-server
+ip -n st-client addr add 10.200.0.1/24 dev st-veth0
+ip -n st-server addr add 10.200.0.2/24 dev st-veth1
+ip -n st-client link set st-veth0 up
+ip -n st-server link set st-veth1 up
+ip -n st-client link set lo up
+ip -n st-server link set lo up
+
+cat > "$DIR/negotiator.json" <<CONFIG
+{
+  "role": "negotiator",
+  "listenAddress": "10.200.0.2:8080",
+  "servers": ["10.200.0.2"]
+}
+CONFIG
+cat > "$DIR/server.json" <<CONFIG
+{
+  "role": "server",
+  "privateKeyFile": "$DIR/server.key",
+  "secret": "tun-netns-test",
+  "keepAliveInterval": [5, 20],
+  "tun": { "name": "st0", "address": "10.201.0.1/24" }
+}
+CONFIG
+
+ip netns exec st-server "$BINARY" "$DIR/negotiator.json" "$DIR/negotiator-logs.txt" &
+ip netns exec st-server "$BINARY" "$DIR/server.json" "$DIR/server-logs.txt" > "$DIR/server.out" &
+sleep 1
+PUBLIC_KEY=$(awk '/PUBLIC KEY/ { print $3 }' "$DIR/server.out")
+
+cat > "$DIR/client.json" <<CONFIG
+{
+  "role": "client",
+  "serverIP": "10.200.0.2",
+  "serverPublicKey": "$PUBLIC_KEY",
+  "secret": "tun-netns-test",
+  "negotiator": "http://10.200.0.2:8080",
+  "keepAliveInterval": [0, 20],
+  "retryDelay": 1,
+  "retryCount": 3,
+  "serviceTimeout": 60,
+  "tun": { "name": "st0", "address": "10.201.0.2/24" }
+}
+CONFIG
+
+ip netns exec st-client "$BINARY" "$DIR/client.json" "$DIR/client-logs.txt" &
+sleep 3
+
+ip netns exec st-client ping -c 3 10.201.0.1
@@ -1,61 +1,121 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 )
 
 // name User to avoid conflict with Client struct
 type User struct {
-	Connection                     *net.UDPConn
-	ConnectionsToLocalApp          map[byte]*net.UDPConn
-	LastReceivedPacketTime         int64
-	Ready                          bool
-	ActualAddress                  *net.UDPAddr
-	ShouldClose                    bool
-	PacketIDToDestinationPortTable map[byte]uint16
+	Connection                 *net.UDPConn
+	ConnectionsToLocalApp      map[byte]*net.UDPConn
+	LastReceivedPacketTime     int64
+	Ready                      bool
+	ActualAddress              *net.UDPAddr
+	ShouldClose                bool
+	PacketIDToDestinationTable map[byte]string
+	PendingUDPPackets          map[byte][][]byte
+	FlowMutex                  sync.Mutex // guards the udp flow maps above
+	Streams                    *StreamTable
+	ReverseListeners           map[string]io.Closer
+	ReverseUDPIDs              map[string]byte
+	ReverseUDPAddresses        map[byte]*net.UDPAddr
+	ReverseUDPListeners        map[byte]*net.UDPConn
+	ReverseUDPLastPacketTime   map[byte]int64
+	ReverseMutex               sync.Mutex
+	Token                      []byte
+	SessionKey                 []byte
+	ServerKey                  []byte // the server's half of the session key
+	LastClientTimestamp        int64
+	PendingAddress             *net.UDPAddr
+	PathChallenge              []byte
+	Capabilities               byte
+	NegotiatedAddress          string
+	TunAddress                 string
+	Ticket                     []byte
+	Handle                     string // names the session in the session api
+	Buffer                     PacketBuffer
 }
 
 type Server struct {
 	ServerToClientConnections map[string]*User
-	BlockedIPs                []string
+	ConnectionsMutex          sync.Mutex // guards ServerToClientConnections
+	Decoy                     http.Handler
+	Bans                      *BanManager
+	SessionLimiter            *SourceRateLimiter
+	PunchLimiter              *SourceRateLimiter
+	Tun                       *Tun
+	TunAddressToUser          map[string]*User
+	TunMutex                  sync.Mutex
+	PrivateKey                *ecdh.PrivateKey
+	SeenNegotiations          map[string]*SeenNegotiation
+	NegotiationMutex          sync.Mutex
 }
 
-func (s *Server) IsBlockedIP(ip string) bool {
-	for _, i := range s.BlockedIPs {
-		if i == ip {
-			return true
+func (s *Server) Start() {
+	s.ServerToClientConnections = make(map[string]*User)
+	s.TunAddressToUser = make(map[string]*User)
+	s.SeenNegotiations = make(map[string]*SeenNegotiation)
+	s.SessionLimiter = NewSourceRateLimiter(config.SessionRateLimit, RateLimitConfig{PerSource: 10, PerSourceBurst: 5, Global: 600, GlobalBurst: 60})
+	s.PunchLimiter = NewSourceRateLimiter(config.PunchRateLimit, RateLimitConfig{PerSource: 30, PerSourceBurst: 10, Global: 1200, GlobalBurst: 120})
+
+	privateKeyFile := config.PrivateKeyFile
+	if privateKeyFile == "" {
+		privateKeyFile = "server.key"
+	}
+	s.PrivateKey = LoadPrivateKey(privateKeyFile)
+	publicKey := base64.StdEncoding.EncodeToString(s.PrivateKey.PublicKey().Bytes())
+	log.Printf("Public key: %s\n", publicKey)
+	fmt.Printf("PUBLIC KEY %s\n", publicKey)
+
+	if config.Tun != nil {
+		s.Tun = OpenTun(config.Tun)
+		if s.Tun.Network == nil {
+			log.Panicf("The server's tun address needs CIDR notation, not %s\n", config.Tun.Address)
 		}
+		go s.ForwardTunPackets()
 	}
-	return false
-}
 
-func (s *Server) Start() {
-	s.ServerToClientConnections = make(map[string]*User)
+	if config.SignalingDirectory != "" {
+		go s.WatchSignalingDirectory()
+	}
 
 	go func() {
 		ticker := time.NewTicker(time.Second * time.Duration(config.KeepAliveInterval[1]))
 		for range ticker.C {
+			s.ConnectionsMutex.Lock()
 			for clientIPAndPort, user := range s.ServerToClientConnections {
 				if user.ShouldClose {
 					delete(s.ServerToClientConnections, clientIPAndPort)
 				}
 				diff := time.Now().Unix() - user.LastReceivedPacketTime
-				if user.Ready && diff > 60 {
-					log.Printf("Evicting disconnected client at %s, received last packet %d seconds ago\n", user.ActualAddress.String(), diff)
+				if diff > 60 {
+					log.Printf("Evicting disconnected client at %s, received last packet %d seconds ago\n", user.NegotiatedAddress, diff)
 					user.ShouldClose = true
+					user.Connection.SetReadDeadline(time.Now())
 				}
+				s.FreeIdleReverseUDPFlows(user, 60)
 			}
+			s.ConnectionsMutex.Unlock()
 		}
 	}()
 
 	go func() {
 		ticker := time.NewTicker(time.Second * time.Duration(config.KeepAliveInterval[0]))
 		for range ticker.C {
+			s.ConnectionsMutex.Lock()
 			for clientIPAndPort, user := range s.ServerToClientConnections {
 				if user.ShouldClose {
 					delete(s.ServerToClientConnections, clientIPAndPort)
@@ -70,87 +130,261 @@ func (s *Server) Start() {
 					user.ShouldClose = true
 				}
 			}
+			s.ConnectionsMutex.Unlock()
 		}
 	}()
 
-	err := http.ListenAndServe("0.0.0.0:80", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if s.IsBlockedIP(r.RemoteAddr) {
-			if hj, ok := w.(http.Hijacker); ok {
-				conn, _, _ := hj.Hijack()
-				conn.Close()
-				return
+	if config.NegotiatorLink != nil {
+		s.PollNegotiator()
+		return
+	}
+
+	s.ListenForControl()
+}
+
+// HandleNegotiationMessage opens a sealed negotiation request that was
+// relayed from clientIP, whichever signaling backend it arrived through, and
+// returns the response along with its sealed form. Rate limits apply to
+// clientIP, since the client chooses the ip sealed into the request, which
+// is only used to punch to. A request routed to a session by its handle has
+// to carry that session's token.
+func (s *Server) HandleNegotiationMessage(clientIP string, message []byte, session string) (*NegotiationResponse, []byte, error) {
+	request, aead, err := OpenNegotiationRequest(message, s.PrivateKey)
+	if err != nil {
+		log.Printf("Rejected negotiation request for %s: %s\n", clientIP, err)
+		negotiationMetrics.Add("rejected", 1)
+		return nil, nil, err
+	}
+	if session != "" && !s.IsSessionToken(session, request.Token) {
+		log.Printf("Rejected negotiation request for %s routed to another session\n", clientIP)
+		negotiationMetrics.Add("rejected", 1)
+		return nil, nil, errors.New("message does not match the route")
+	}
+	sourceIP := clientIP
+	if request.ClientIP != nil {
+		clientIP = request.ClientIP.String()
+	}
+	seen, repeated := s.SeenNegotiation(negotiationNonce(message))
+	if repeated {
+		select {
+		case <-seen.Done:
+			if seen.Response != nil {
+				break
 			}
-			w.WriteHeader(500)
-			return
+			return nil, nil, errors.New("repeated negotiation request was not answered")
+		case <-time.After(repeatedNegotiationWait):
+			log.Printf("Rejected repeated negotiation request for %s that is still being handled\n", clientIP)
+			negotiationMetrics.Add("replayed", 1)
+			return nil, nil, errors.New("replayed negotiation request")
 		}
+		log.Printf("Answering repeated negotiation request %d for %s with the earlier response\n", request.Method, clientIP)
+		negotiationMetrics.Add("repeated", 1)
+		return seen.Response, seen.Sealed, nil
+	}
+	defer close(seen.Done)
+	clientIPAndPort := net.JoinHostPort(clientIP, strconv.Itoa(int(request.ClientPort)))
+	var response *NegotiationResponse
+	if limit := s.RateLimit(sourceIP, request.Method); limit != "" {
+		log.Printf("Negotiation request %d for %s from %s hit the %s rate limit\n", request.Method, clientIPAndPort, sourceIP, limit)
+		negotiationMetrics.Add("rate_limited_"+limit, 1)
+		response = &NegotiationResponse{Version: negotiationVersion, Status: http.StatusTooManyRequests, Capabilities: localCapabilities()}
+	} else {
+		response = s.HandleNegotiation(clientIPAndPort, request)
+	}
+	negotiationMetrics.Add(fmt.Sprintf("status_%d", response.Status), 1)
+	log.Printf("Negotiation request %d for %s answered with %d\n", request.Method, clientIPAndPort, response.Status)
+	seen.Response, seen.Sealed = response, SealNegotiationResponse(response, aead)
+	return seen.Response, seen.Sealed, nil
+}
 
-		urlParts := strings.Split(r.URL.String(), "/")
-		clientIPAndPort := urlParts[len(urlParts)-1]
+// RateLimit takes a token for a request relayed from sourceIP and returns the
+// limit it hit, if any. Allocating a port costs a socket and a goroutine and punch
+// sends a packet anywhere, tearing down is free.
+func (s *Server) RateLimit(sourceIP string, method byte) string {
+	switch method {
+	case negotiateAllocate:
+		negotiationMetrics.Add("allocate", 1)
+		return s.SessionLimiter.Allow(sourceIP)
+	case negotiatePunch:
+		negotiationMetrics.Add("punch", 1)
+		return s.PunchLimiter.Allow(sourceIP)
+	case negotiateResume:
+		negotiationMetrics.Add("resume", 1)
+		return s.SessionLimiter.Allow(sourceIP)
+	}
+	negotiationMetrics.Add("teardown", 1)
+	return ""
+}
 
-		if isValid := isValidAddress(clientIPAndPort); !isValid {
-			w.WriteHeader(500)
-			s.BlockedIPs = append(s.BlockedIPs, getIPFromAddress(r.RemoteAddr))
-			log.Printf("Blocked %s\n", getIPFromAddress(r.RemoteAddr))
-			return
+// IsSessionToken returns whether the session with handle was made with token.
+func (s *Server) IsSessionToken(handle string, token []byte) bool {
+	s.ConnectionsMutex.Lock()
+	defer s.ConnectionsMutex.Unlock()
+	for _, user := range s.ServerToClientConnections {
+		if user.Handle == handle {
+			return hmac.Equal(user.Token, token)
 		}
+	}
+	return false
+}
 
-		log.Printf("%s %s\n", r.Method, r.URL.String())
+// SeenNegotiation is a request the server has answered, or is answering
+// until Done is closed.
+type SeenNegotiation struct {
+	Expiry   time.Time
+	Done     chan struct{}
+	Response *NegotiationResponse
+	Sealed   []byte
+}
 
-		if r.Method == "GET" {
-			if _, ok := s.ServerToClientConnections[clientIPAndPort]; ok {
-				w.WriteHeader(400)
-				return
+// SeenNegotiation returns the request with nonce and whether it has been seen
+// before. Nonces are kept for as long as their requests would be accepted,
+// and a request that arrives again, because a dns query was retried or the
+// client failed over to another negotiator after the first one delivered it,
+// gets the same response instead of being handled twice.
+func (s *Server) SeenNegotiation(nonce []byte) (*SeenNegotiation, bool) {
+	s.NegotiationMutex.Lock()
+	defer s.NegotiationMutex.Unlock()
+	now := time.Now()
+	for n, seen := range s.SeenNegotiations {
+		if now.After(seen.Expiry) {
+			delete(s.SeenNegotiations, n)
+		}
+	}
+	if seen, ok := s.SeenNegotiations[string(nonce)]; ok {
+		return seen, true
+	}
+	seen := &SeenNegotiation{Expiry: now.Add(maxNegotiationAge * 2), Done: make(chan struct{})}
+	s.SeenNegotiations[string(nonce)] = seen
+	return seen, false
+}
+
+// HandleNegotiation serves a negotiation request for the client at
+// clientIPAndPort: allocate opens a port for the client, punch sends it a
+// dummy packet and tear down closes the connection. Requests after allocate
+// must carry the token it was made with, except resume, which finds the
+// session by its token and moves it to clientIPAndPort. Requests are handled
+// one at a time, as they come in concurrently from every signaling backend.
+func (s *Server) HandleNegotiation(clientIPAndPort string, request *NegotiationRequest) *NegotiationResponse {
+	s.ConnectionsMutex.Lock()
+	defer s.ConnectionsMutex.Unlock()
+	response := &NegotiationResponse{Version: negotiationVersion, Capabilities: localCapabilities()}
+	if request.Method == negotiateResume {
+		user, status := s.ResumeSession(clientIPAndPort, request.Token, request.Key)
+		response.Status = uint16(status)
+		if user != nil {
+			response.ServerPort = portNumber(getPortFromAddress(user.Connection.LocalAddr().String()))
+			response.Key = user.Ticket
+			response.Session = user.Handle
+		}
+		return response
+	}
+	user, ok := s.ServerToClientConnections[clientIPAndPort]
+	if ok && !bytes.Equal(user.Token, request.Token) {
+		response.Status = 403
+		return response
+	}
+	if ok {
+		response.Session = user.Handle
+	}
+	if request.Method == negotiateAllocate {
+		if ok {
+			// the same allocation sent again in a new request, for example
+			// after the client gave up waiting for the first answer, gets
+			// the same key, another one made with the token does not
+			if !bytes.Equal(sessionKey(request.Key, user.ServerKey), user.SessionKey) {
+				response.Status = 409
+				return response
 			}
-			lAddr := resolveAddress("0.0.0.0:0")
-			conn, err := net.ListenUDP("udp", lAddr)
+			response.Status = 200
+			response.ServerPort = portNumber(getPortFromAddress(user.Connection.LocalAddr().String()))
+			response.Key = user.ServerKey
+			return response
+		}
+		conn, err := net.ListenUDP(udpNetwork(getIPFromAddress(clientIPAndPort)), &net.UDPAddr{})
+		if err != nil {
+			log.Panic(err)
+		}
+		serverKey := randomBytes(32)
+		user := &User{Ready: false, ShouldClose: false, ActualAddress: nil, Connection: conn, ConnectionsToLocalApp: make(map[byte]*net.UDPConn), PacketIDToDestinationTable: make(map[byte]string), PendingUDPPackets: make(map[byte][][]byte)}
+		user.Token = request.Token
+		user.ServerKey = serverKey
+		user.SessionKey = sessionKey(request.Key, serverKey)
+		user.Capabilities = request.Capabilities
+		user.NegotiatedAddress = clientIPAndPort
+		user.Ticket = sessionTicket(user.SessionKey)
+		user.Handle = hex.EncodeToString(randomBytes(8))
+		user.LastReceivedPacketTime = time.Now().Unix()
+		user.ReverseListeners = make(map[string]io.Closer)
+		user.ReverseUDPIDs = make(map[string]byte)
+		user.ReverseUDPAddresses = make(map[byte]*net.UDPAddr)
+		user.ReverseUDPListeners = make(map[byte]*net.UDPConn)
+		user.ReverseUDPLastPacketTime = make(map[byte]int64)
+		user.Streams = newStreamTable(user.Send, func(destination []byte) (net.Conn, error) {
+			address, err := DecodeDestination(destination)
 			if err != nil {
-				log.Panic(err)
+				return nil, err
 			}
-			s.ServerToClientConnections[clientIPAndPort] = &User{Ready: false, ShouldClose: false, ActualAddress: nil, Connection: conn, ConnectionsToLocalApp: make(map[byte]*net.UDPConn), PacketIDToDestinationPortTable: make(map[byte]uint16)}
-			w.Write([]byte(getPortFromAddress(conn.LocalAddr().String())))
-			go s.HandleClient(clientIPAndPort)
-		} else if r.Method == "POST" {
-			if _, ok := s.ServerToClientConnections[clientIPAndPort]; ok {
-				go s.SendDummyPacket(clientIPAndPort)
-				w.WriteHeader(200)
-			} else {
-				w.WriteHeader(400)
-			}
-		} else {
-			w.WriteHeader(500)
-			s.BlockedIPs = append(s.BlockedIPs, getIPFromAddress(r.RemoteAddr))
+			return net.DialTimeout("tcp", address, streamDialTimeout)
+		})
+		s.ServerToClientConnections[clientIPAndPort] = user
+		go s.HandleClient(user)
+		response.Status = 200
+		response.ServerPort = portNumber(getPortFromAddress(conn.LocalAddr().String()))
+		response.Key = serverKey
+		response.Session = user.Handle
+		return response
+	}
+	if !ok {
+		response.Status = 404
+		return response
+	}
+	if request.Method == negotiatePunch {
+		address := user.ActualAddress
+		if address == nil {
+			address = resolveAddress(clientIPAndPort)
 		}
-	}))
-	if err != nil {
-		log.Panic(err)
+		go s.SendDummyPacket(user, address)
+		response.Status = 200
+	} else if request.Method == negotiateTearDown {
+		log.Printf("Tearing down connection to %s\n", clientIPAndPort)
+		user.ShouldClose = true
+		user.Connection.SetReadDeadline(time.Now())
+		response.Status = 200
+	} else {
+		response.Status = 400
 	}
+	return response
 }
 
-func (s *Server) SendDummyPacket(clientIPAndPort string) {
-	if s.ServerToClientConnections[clientIPAndPort].ActualAddress == nil {
-		s.ServerToClientConnections[clientIPAndPort].ActualAddress = resolveAddress(clientIPAndPort)
-	}
-	_, err := s.ServerToClientConnections[clientIPAndPort].Connection.WriteToUDP([]byte{1, 0}, s.ServerToClientConnections[clientIPAndPort].ActualAddress)
+// SendDummyPacket punches to the client at address, the verified address of
+// the session or the negotiated one before it has one.
+func (s *Server) SendDummyPacket(user *User, address *net.UDPAddr) {
+	_, err := user.Connection.WriteToUDP(TimestampedPacket(1, user.SessionKey, fromServer), address)
 	if err != nil {
-		log.Printf("Failed to send dummy packet to client at %s\n", s.ServerToClientConnections[clientIPAndPort].ActualAddress)
-		s.ServerToClientConnections[clientIPAndPort].ShouldClose = true
+		log.Printf("Failed to send dummy packet to client at %s\n", address)
+		user.ShouldClose = true
 		return
 	}
-	log.Printf("Sent dummy packet to %s\n", clientIPAndPort)
+	log.Printf("Sent dummy packet to %s\n", address)
 }
 
-func (s *Server) HandleClient(clientIPAndPort string) {
-	connectionToClient := s.ServerToClientConnections[clientIPAndPort].Connection
-	user := s.ServerToClientConnections[clientIPAndPort]
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+func (s *Server) HandleClient(user *User) {
+	clientIPAndPort := user.NegotiatedAddress
+	connectionToClient := user.Connection
 	var packet Packet
 	buffer := make([]byte, 1024*8)
 	var n int
 	var err error
-	var clientActualAddress *net.UDPAddr
+	var from *net.UDPAddr
 
 mainLoop:
 	for {
-		n, clientActualAddress, err = connectionToClient.ReadFromUDP(buffer)
+		n, from, err = connectionToClient.ReadFromUDP(buffer)
 		if user.ShouldClose {
 			break mainLoop
 		}
@@ -163,109 +397,297 @@ mainLoop:
 			break mainLoop
 		}
 
+		// anything that is not from the verified address, a valid dummy
+		// packet from the negotiated ip or part of an address change is
+		// dropped without an answer
+		signed, isPathResponse := false, false
+		isDummy := buffer[0] == 1 && ((!user.Ready && from.IP.Equal(net.ParseIP(getIPFromAddress(user.NegotiatedAddress)))) || (user.Ready && sameUDPAddr(from, user.ActualAddress)))
+		if n >= 2 && (isDummy || (buffer[0] == 14 && user.Ready)) {
+			var timestamp int64
+			timestamp, signed = VerifyTimestampedPacket(buffer[:n], buffer[0], user.SessionKey, fromClient, user.LastClientTimestamp)
+			if signed {
+				user.LastClientTimestamp = timestamp
+			}
+		} else if n >= 2 && buffer[0] == 16 && user.PathChallenge != nil && sameUDPAddr(from, user.PendingAddress) {
+			body, ok := VerifySignedPacket(buffer[:n], 16, user.SessionKey, fromClient)
+			isPathResponse = ok && bytes.Equal(body, user.PathChallenge)
+		}
+		if n < 2 || (!signed && !isPathResponse && (!user.Ready || !sameUDPAddr(from, user.ActualAddress))) {
+			negotiationMetrics.Add("dropped_packets", 1)
+			continue
+		}
+
 		user.LastReceivedPacketTime = time.Now().Unix()
 
 		packet.DecodePacket(buffer[:n])
 
 		// handle flags
 		if packet.Flags > 0 {
-			if packet.Flags == 1 { // dummy
-				user.Ready = true
-				log.Printf("Received dummy packet from %s\n", clientIPAndPort)
-				user.ActualAddress = clientActualAddress
-				if clientActualAddress.String() != clientIPAndPort {
-					log.Printf("Actual address for %s is %s\n", clientIPAndPort, clientActualAddress.String())
+			if packet.Flags == 1 && signed { // dummy
+				wasReady := user.Ready
+				if !wasReady {
+					log.Printf("Received dummy packet from %s\n", user.NegotiatedAddress)
+					if from.String() != user.NegotiatedAddress {
+						log.Printf("Actual address for %s is %s\n", user.NegotiatedAddress, from.String())
+					}
+					user.ActualAddress = from
+					user.Ready = true
 				}
+				connectionToClient.WriteToUDP(TimestampedPacket(1, user.SessionKey, fromServer), from)
+				if n := user.Buffer.Flush(user.Send); !wasReady && n > 0 {
+					log.Printf("Sent %d packets buffered while %s was resuming\n", n, user.NegotiatedAddress)
+				}
+			} else if packet.Flags == 14 && signed && !sameUDPAddr(from, user.ActualAddress) { // address change
+				user.PendingAddress = from
+				user.PathChallenge = randomBytes(pathChallengeLength)
+				log.Printf("Client at %s is moving to %s, sending path challenge\n", user.ActualAddress, from)
+				connectionToClient.WriteToUDP(SignedPacket(15, user.SessionKey, fromServer, user.PathChallenge), from)
+			} else if packet.Flags == 16 && isPathResponse { // path response
+				log.Printf("Client at %s moved to %s\n", user.ActualAddress, from)
+				negotiationMetrics.Add("migrations", 1)
+				user.ActualAddress = from
+				user.PendingAddress = nil
+				user.PathChallenge = nil
 			} else if packet.Flags == 3 { // close connection
 				log.Printf("Received close connection packet from %s\n", clientIPAndPort)
 				user.ShouldClose = true
 				break mainLoop
-			} else if packet.Flags == 4 { // destination port announcement
-				if len(packet.Payload) >= 2 {
-					user.PacketIDToDestinationPortTable[packet.ID] = ByteSliceToUint16(packet.Payload)
-					log.Printf("Received destination announcement packet with id %d for port %d\n", packet.ID, user.PacketIDToDestinationPortTable[packet.ID])
+			} else if packet.Flags == 4 { // destination announcement
+				if destination, err := DecodeDestination(packet.Payload); err == nil {
+					user.FlowMutex.Lock()
+					if conn, ok := user.ConnectionsToLocalApp[packet.ID]; ok {
+						conn.Close()
+						delete(user.ConnectionsToLocalApp, packet.ID)
+					}
+					user.PacketIDToDestinationTable[packet.ID] = destination
+					delete(user.PendingUDPPackets, packet.ID)
+					user.FlowMutex.Unlock()
+					log.Printf("Received destination announcement packet with id %d for %s\n", packet.ID, destination)
+					go user.OpenUDPFlow(packet.ID, destination)
 				} else {
-					log.Printf("Received invalid destination port announcement packet from %s\n", user.ActualAddress)
+					log.Printf("Received invalid destination announcement packet from %s\n%s\n", user.ActualAddress, err)
 				}
 			} else if packet.Flags == 6 { // free id
+				user.FlowMutex.Lock()
+				if conn, ok := user.ConnectionsToLocalApp[packet.ID]; ok {
+					conn.Close()
+				}
 				delete(user.ConnectionsToLocalApp, packet.ID)
-				delete(user.PacketIDToDestinationPortTable, packet.ID)
+				delete(user.PacketIDToDestinationTable, packet.ID)
+				delete(user.PendingUDPPackets, packet.ID)
+				user.FlowMutex.Unlock()
+			} else if isStreamFlag(packet.Flags) && user.ActualAddress != nil {
+				user.Streams.HandlePacket(&packet)
+			} else if packet.Flags == 12 && s.Tun != nil { // ip packet
+				s.WriteTunPacket(user, packet.Payload)
+			} else if packet.Flags == 13 { // reverse service registration
+				s.RegisterReverseService(user, packet.Payload)
 			}
 			continue mainLoop
 		}
 
-		if connectionToLocalApp, ok := user.ConnectionsToLocalApp[packet.ID]; ok {
-			_, err = connectionToLocalApp.Write(packet.Payload)
-			if err != nil {
-				if user.ShouldClose {
-					break mainLoop
-				}
-				log.Printf("Error writing packet to 0.0.0.0:%d\n%s\n", user.PacketIDToDestinationPortTable[packet.ID], err)
-				user.ShouldClose = true
-				break mainLoop
-			}
-		} else {
-			if _, ok := user.PacketIDToDestinationPortTable[packet.ID]; !ok {
-				continue
+		if packet.ID >= firstReverseID {
+			s.WriteReverseUDPPacket(user, &packet)
+			continue mainLoop
+		}
+
+		user.FlowMutex.Lock()
+		connectionToLocalApp, ok := user.ConnectionsToLocalApp[packet.ID]
+		destination, announced := user.PacketIDToDestinationTable[packet.ID]
+		if !ok && announced && len(user.PendingUDPPackets[packet.ID]) < udpFlowPendingPackets {
+			// the flow is still being opened
+			user.PendingUDPPackets[packet.ID] = append(user.PendingUDPPackets[packet.ID], append([]byte{}, packet.Payload...))
+		}
+		user.FlowMutex.Unlock()
+		if !ok {
+			continue
+		}
+		if _, err = connectionToLocalApp.Write(packet.Payload); err != nil {
+			log.Printf("Error writing packet to %s\n%s\n", destination, err)
+			user.CloseUDPFlow(packet.ID, connectionToLocalApp)
+		}
+	}
+	user.Streams.CloseAll()
+	user.FlowMutex.Lock()
+	for _, conn := range user.ConnectionsToLocalApp {
+		conn.Close()
+	}
+	user.FlowMutex.Unlock()
+	s.CloseReverseServices(user)
+	s.TunMutex.Lock()
+	for address, u := range s.TunAddressToUser {
+		if u == user {
+			delete(s.TunAddressToUser, address)
+		}
+	}
+	s.TunMutex.Unlock()
+	connectionToClient.WriteToUDP([]byte{3, 0}, user.ActualAddress)
+	log.Printf("Sent close connection packet to %s\n", user.ActualAddress)
+	connectionToClient.Close()
+	log.Printf("Closed connection to %s\n", user.NegotiatedAddress)
+	s.ConnectionsMutex.Lock()
+	if s.ServerToClientConnections[user.NegotiatedAddress] == user {
+		delete(s.ServerToClientConnections, user.NegotiatedAddress)
+	}
+	s.ConnectionsMutex.Unlock()
+}
+
+// udpFlowPendingPackets is how many packets of a udp flow are kept while its
+// destination is resolved, later ones are dropped.
+const udpFlowPendingPackets = 16
+
+// OpenUDPFlow resolves and dials the destination announced for the udp flow
+// with id, away from the client's read loop so a slow dns lookup only holds
+// up this flow, and then sends the packets that arrived in the meantime.
+func (u *User) OpenUDPFlow(id byte, destination string) {
+	conn, err := func() (*net.UDPConn, error) {
+		serviceAddress, err := net.ResolveUDPAddr("udp", destination)
+		if err != nil {
+			return nil, err
+		}
+		return net.DialUDP("udp", nil, serviceAddress)
+	}()
+	if err != nil {
+		log.Printf("Failed to open connection to %s for packets with id %d\n%s\n", destination, id, err)
+		u.FlowMutex.Lock()
+		current, ok := u.PacketIDToDestinationTable[id]
+		u.FlowMutex.Unlock()
+		if ok && current == destination {
+			u.CloseUDPFlow(id, nil)
+		}
+		return
+	}
+	u.FlowMutex.Lock()
+	current, ok := u.PacketIDToDestinationTable[id]
+	_, opened := u.ConnectionsToLocalApp[id]
+	if !ok || current != destination || opened || u.ShouldClose {
+		// freed or announced again while it was being opened
+		u.FlowMutex.Unlock()
+		conn.Close()
+		return
+	}
+	// pending packets go out before the flow is published, so they stay in
+	// order with the ones that follow
+	for _, payload := range u.PendingUDPPackets[id] {
+		if _, err = conn.Write(payload); err != nil {
+			break
+		}
+	}
+	delete(u.PendingUDPPackets, id)
+	if err == nil {
+		u.ConnectionsToLocalApp[id] = conn
+	}
+	u.FlowMutex.Unlock()
+	if err != nil {
+		log.Printf("Error writing packet to %s\n%s\n", destination, err)
+		conn.Close()
+		u.CloseUDPFlow(id, nil)
+		return
+	}
+	log.Printf("Created new connection to %s for packets with id %d\n", conn.RemoteAddr().String(), id)
+	go u.ReadUDPFlow(id, conn)
+}
+
+// ReadUDPFlow sends the packets conn receives from the destination of the
+// udp flow with id to the client, until the flow is closed.
+func (u *User) ReadUDPFlow(id byte, conn *net.UDPConn) {
+	packet := createPacket()
+	packet.ID = id
+	buffer := make([]byte, (1024*8)-2)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			if !u.ShouldClose && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error reading packet from %s\n%s\n", conn.RemoteAddr().String(), err)
+				u.CloseUDPFlow(id, conn)
 			}
-			serviceAddress := resolveAddress(fmt.Sprintf("0.0.0.0:%d", user.PacketIDToDestinationPortTable[packet.ID]))
-			user.ConnectionsToLocalApp[packet.ID], err = net.DialUDP("udp", nil, serviceAddress)
-			if err != nil {
-				if user.ShouldClose {
-					break mainLoop
-				}
-				log.Printf("Failed to dial service at %s\n", serviceAddress)
-				user.ShouldClose = true
-				break mainLoop
+			return
+		}
+		packet.Payload = buffer[:n]
+		if err = u.Send(packet.EncodePacket()); err != nil {
+			if u.ShouldClose {
+				return
 			}
+			log.Printf("Error writing packet to %s\n%s\n", u.ActualAddress, err)
+			u.ShouldClose = true
+			return
+		}
+	}
+}
 
-			connectionToLocalApp := user.ConnectionsToLocalApp[packet.ID]
-			log.Printf("Created new connection to %s for packets with id %d\n", connectionToLocalApp.RemoteAddr().String(), packet.ID)
+// CloseUDPFlow closes conn, the connection of the udp flow with id, and tells
+// the client to free the id, so a destination that fails only ends its own
+// flow. A nil conn closes a flow that has no connection yet.
+func (u *User) CloseUDPFlow(id byte, conn *net.UDPConn) {
+	u.FlowMutex.Lock()
+	current, ok := u.ConnectionsToLocalApp[id]
+	open := ok == (conn != nil) && current == conn
+	if open {
+		delete(u.ConnectionsToLocalApp, id)
+		delete(u.PacketIDToDestinationTable, id)
+		delete(u.PendingUDPPackets, id)
+	}
+	u.FlowMutex.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	if open {
+		u.Send([]byte{6, id})
+	}
+}
 
-			_, err = connectionToLocalApp.Write(packet.Payload)
-			if err != nil {
-				if user.ShouldClose {
-					break mainLoop
-				}
-				log.Printf("Error writing packet to 0.0.0.0:%d\n%s\n", user.PacketIDToDestinationPortTable[packet.ID], err)
-				user.ShouldClose = true
-				break mainLoop
-			}
+// WriteTunPacket writes an ip packet from user to the tun interface. Every
+// user gets a single address in the tun network, the source of its first
+// packet that is not the server's own or taken by another user, so replies
+// can be routed back. Packets from any other source are dropped.
+func (s *Server) WriteTunPacket(user *User, ipPacket []byte) {
+	source, _, ok := GetIPPacketAddresses(ipPacket)
+	if !ok || !s.Tun.Network.Contains(source) || source.Equal(s.Tun.IP) {
+		return
+	}
+	s.TunMutex.Lock()
+	if user.TunAddress == "" {
+		if u, ok := s.TunAddressToUser[source.String()]; ok && !u.ShouldClose {
+			s.TunMutex.Unlock()
+			return
+		}
+		user.TunAddress = source.String()
+		s.TunAddressToUser[user.TunAddress] = user
+		log.Printf("Assigned tun address %s to client at %s\n", user.TunAddress, user.ActualAddress.String())
+	} else if user.TunAddress != source.String() {
+		s.TunMutex.Unlock()
+		return
+	}
+	s.TunMutex.Unlock()
+	_, err := s.Tun.File.Write(ipPacket)
+	if err != nil {
+		log.Printf("Error writing ip packet to %s\n%s\n", s.Tun.Name, err)
+	}
+}
 
-			go func(id byte) {
-				packet := createPacket()
-				buffer := make([]byte, (1024*8)-2)
-				var n int
-				var err error
-				for {
-					n, err = connectionToLocalApp.Read(buffer)
-					if err != nil {
-						if user.ShouldClose {
-							break
-						}
-						log.Printf("Error reading packet from %s\t\n%s\n", connectionToLocalApp.RemoteAddr().String(), err)
-						user.ShouldClose = true
-						break
-					}
-					packet.Flags = 0
-					packet.ID = id
-					packet.Payload = buffer[:n]
-					_, err = connectionToClient.WriteToUDP(packet.EncodePacket(), clientActualAddress)
-					if err != nil {
-						if user.ShouldClose {
-							break
-						}
-						log.Printf("Error writing packet to %s\n%s\n", connectionToClient.RemoteAddr().String(), err)
-						user.ShouldClose = true
-						break
-					}
-				}
-			}(packet.ID)
+// ForwardTunPackets sends ip packets read from the tun interface to the
+// user owning their destination address.
+func (s *Server) ForwardTunPackets() {
+	buffer := make([]byte, 1024*8)
+	buffer[0] = 12
+	for {
+		n, err := s.Tun.File.Read(buffer[2:])
+		if err != nil {
+			log.Panicln(err)
+		}
+		_, destination, ok := GetIPPacketAddresses(buffer[2 : 2+n])
+		if !ok {
+			continue
+		}
+		s.TunMutex.Lock()
+		user, ok := s.TunAddressToUser[destination.String()]
+		s.TunMutex.Unlock()
+		if !ok || user.ShouldClose {
+			continue
+		}
+		err = user.Send(buffer[:2+n])
+		if err != nil {
+			log.Printf("Error writing ip packet to client at %s\n%s\n", user.ActualAddress.String(), err)
 		}
 	}
-	connectionToClient.WriteToUDP([]byte{3, 0}, user.ActualAddress)
-	log.Printf("Sent close connection packet to %s\n", clientActualAddress.String())
-	connectionToClient.Close()
-	log.Printf("Closed connection to %s\n", clientActualAddress.String())
-	delete(s.ServerToClientConnections, clientIPAndPort)
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSeenNegotiation(t *testing.T) {
+	s := &Server{SeenNegotiations: make(map[string]*SeenNegotiation)}
+	first, seen := s.SeenNegotiation([]byte("nonce 1"))
+	if seen {
+		t.Fatal("a new nonce was seen")
+	}
+	if _, seen := s.SeenNegotiation([]byte("nonce 2")); seen {
+		t.Fatal("a second new nonce was seen")
+	}
+	repeated, seen := s.SeenNegotiation([]byte("nonce 1"))
+	if !seen || repeated != first {
+		t.Fatal("a replayed nonce was not seen")
+	}
+
+	first.Expiry = time.Now().Add(-time.Second)
+	if _, seen := s.SeenNegotiation([]byte("nonce 1")); seen {
+		t.Error("an expired nonce was still seen")
+	}
+	if len(s.SeenNegotiations) != 2 {
+		t.Errorf("%d nonces remembered, want 2", len(s.SeenNegotiations))
+	}
+}
+
+// readTestPacket returns the next packet on conn that is not a dummy packet.
+func readTestPacket(t *testing.T, conn *net.UDPConn) []byte {
+	t.Helper()
+	buffer := make([]byte, 1024*8)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n >= 2 && buffer[0] != 1 {
+			return buffer[:n]
+		}
+	}
+}
+
+// listenTestEcho returns a udp echo server on 127.0.0.1.
+func listenTestEcho(t *testing.T) *net.UDPConn {
+	t.Helper()
+	echo, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buffer[:n], from)
+		}
+	}()
+	return echo
+}
+
+func TestUDPFlowKeepsPacketsWhileOpening(t *testing.T) {
+	s := newTestServer()
+	conn, clientIPAndPort, token, key := newTestSession(t, s)
+	punchTestSession(t, s, conn, clientIPAndPort, token, key)
+	echo := listenTestEcho(t)
+
+	// the destination is a name, which is resolved after the announcement
+	// while the packets behind it are already arriving
+	destination, err := EncodeDestination(net.JoinHostPort("localhost", getPortFromAddress(echo.LocalAddr().String())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append([]byte{4, 0}, destination...))
+	for i := byte(0); i < 3; i++ {
+		conn.Write([]byte{0, 0, i})
+	}
+	for i := byte(0); i < 3; i++ {
+		if packet := readTestPacket(t, conn); !bytes.Equal(packet, []byte{0, 0, i}) {
+			t.Fatalf("received %v, want packet %d echoed", packet, i)
+		}
+	}
+}
+
+func TestFailedUDPFlowKeepsSession(t *testing.T) {
+	s := newTestServer()
+	conn, clientIPAndPort, token, key := newTestSession(t, s)
+	punchTestSession(t, s, conn, clientIPAndPort, token, key)
+
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddress := closed.LocalAddr().String()
+	closed.Close()
+	echo := listenTestEcho(t)
+
+	for id, address := range []string{closedAddress, echo.LocalAddr().String()} {
+		destination, err := EncodeDestination(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(append([]byte{4, byte(id)}, destination...))
+	}
+	// the closed port answers the first packet with an icmp error, which
+	// fails the second one
+	conn.Write([]byte{0, 0, 'a'})
+	if packet := readTestPacket(t, conn); !bytes.Equal(packet, []byte{6, 0}) {
+		conn.Write([]byte{0, 0, 'b'})
+		if packet := readTestPacket(t, conn); !bytes.Equal(packet, []byte{6, 0}) {
+			t.Fatalf("received %v instead of the flow being freed", packet)
+		}
+	}
+
+	conn.Write([]byte{0, 1, 'c'})
+	if packet := readTestPacket(t, conn); !bytes.Equal(packet, []byte{0, 1, 'c'}) {
+		t.Fatalf("received %v instead of the echo, the session was closed", packet)
+	}
+}
+
+func TestRateLimitIgnoresSealedClientIP(t *testing.T) {
+	s := newTestServer()
+	serverKey := testServerKey(t)
+	s.PrivateKey = serverKey
+	s.PunchLimiter = NewSourceRateLimiter(&RateLimitConfig{PerSource: 1, PerSourceBurst: 2, Global: -1}, RateLimitConfig{})
+
+	// a client sealing a different ip into every request
+	for i, status := range []uint16{404, 404, 429} {
+		request := testNegotiationRequest(negotiatePunch, net.IPv4(198, 51, 100, byte(i+1)))
+		message, _, err := SealNegotiationRequest(request, serverKey.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, _, err := s.HandleNegotiationMessage("203.0.113.1", message, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Status != status {
+			t.Errorf("request %d answered with %d, want %d", i+1, response.Status, status)
+		}
+	}
+}
+
+func TestConcurrentNegotiations(t *testing.T) {
+	s := newTestServer()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			clientIPAndPort := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+			token := randomBytes(16)
+			for _, method := range []byte{negotiateAllocate, negotiatePunch, negotiateTearDown} {
+				request := &NegotiationRequest{Version: negotiationVersion, Method: method, Token: token, Key: randomBytes(negotiationKeyLength)}
+				if response := s.HandleNegotiation(clientIPAndPort, request); response.Status != 200 {
+					t.Errorf("request %d for %s answered with %d", method, clientIPAndPort, response.Status)
+				}
+			}
+		}(40000 + i)
+	}
+	wg.Wait()
+}
+
+func TestRepeatedAllocate(t *testing.T) {
+	s := newTestServer()
+	clientIPAndPort := net.JoinHostPort("127.0.0.1", (&Client{}).SelectPort("127.0.0.1"))
+	request := &NegotiationRequest{Version: negotiationVersion, Method: negotiateAllocate, Token: randomBytes(16), Key: randomBytes(negotiationKeyLength)}
+	first := s.HandleNegotiation(clientIPAndPort, request)
+	if first.Status != 200 {
+		t.Fatalf("allocate answered with %d", first.Status)
+	}
+	t.Cleanup(func() {
+		s.HandleNegotiation(clientIPAndPort, &NegotiationRequest{Version: negotiationVersion, Method: negotiateTearDown, Token: request.Token})
+	})
+
+	again := s.HandleNegotiation(clientIPAndPort, request)
+	if again.Status != 200 || again.ServerPort != first.ServerPort || !bytes.Equal(again.Key, first.Key) {
+		t.Errorf("repeated allocate answered with %d, port %d and key %x, want 200, %d and %x", again.Status, again.ServerPort, again.Key, first.ServerPort, first.Key)
+	}
+	other := *request
+	other.Key = randomBytes(negotiationKeyLength)
+	if response := s.HandleNegotiation(clientIPAndPort, &other); response.Status != 409 || response.Key != nil {
+		t.Errorf("allocate with another key answered with %d and key %x, want 409", response.Status, response.Key)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signaling carries sealed negotiation messages from the client to the
+// server and back, so the client can switch channels when one of them is
+// blocked. It is selected with the signaling option: "http" (default), "dns"
+// or "file".
+type Signaling interface {
+	// Exchange sends message to the server at serverIP and returns its
+	// answer.
+	Exchange(serverIP string, message []byte) ([]byte, error)
+	// ClientIP returns the client's public ip to seal into requests for
+	// serverIP, or "" if the server can use the ip they are relayed from.
+	ClientIP(serverIP string) (string, error)
+}
+
+func NewSignaling() Signaling {
+	switch config.Signaling {
+	case "", "http":
+		if len(config.Negotiators) == 0 {
+			log.Panicln("http signaling needs a negotiator")
+		}
+		stateFile := config.NegotiatorStateFile
+		if stateFile == "" {
+			stateFile = "negotiators.json"
+		}
+		return &HTTPSignaling{Pool: NewNegotiatorPool(config.Negotiators, stateFile)}
+	case "dns":
+		if config.SignalingDomain == "" {
+			log.Panicln("dns signaling needs signalingDomain")
+		}
+		return &DNSSignaling{Domain: config.SignalingDomain}
+	case "file":
+		if config.SignalingDirectory == "" {
+			log.Panicln("file signaling needs signalingDirectory")
+		}
+		return &FileSignaling{Directory: config.SignalingDirectory}
+	}
+	log.Panicf("Unknown signaling %s\n", config.Signaling)
+	return nil
+}
+
+// NegotiatorRequest is what clients post to the negotiator. Only the server
+// ip is readable, the message is sealed to the server's key.
+type NegotiatorRequest struct {
+	Version int    `json:"version"`
+	Server  string `json:"server"`
+	Message []byte `json:"message"`
+}
+
+// HTTPSignaling posts messages to a negotiator over http(s), which relays
+// them to the server along with the client's ip. Negotiators are tried from
+// best to worst until one of them answers. Every one of them is sent the same
+// sealed message: if an earlier one delivered it but its answer was lost, the
+// server recognizes the repeated request and answers it again from its cache
+// instead of rejecting it as a replay or allocating a second port.
+type HTTPSignaling struct {
+	Pool      *NegotiatorPool
+	PublicIPs PublicIPs
+}
+
+func (h *HTTPSignaling) Exchange(serverIP string, message []byte) ([]byte, error) {
+	request := NegotiatorRequest{Version: negotiationVersion, Server: serverIP, Message: message}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	if h.Pool.ShouldProbe() {
+		h.Pool.Probe(serverIP)
+	}
+	for _, n := range h.Pool.Ranked() {
+		start := time.Now()
+		var answer []byte
+		answer, err = h.post(n.Config, serverIP, body)
+		h.Pool.Record(n, time.Since(start), err == nil)
+		if err == nil {
+			h.Pool.Save()
+			return answer, nil
+		}
+		if isTLSVerificationError(err) {
+			log.Printf("TLS verification of negotiator %s failed, the connection may be intercepted\n%s\n", n.Name, err)
+			fmt.Printf("TLS VERIFICATION FAILED %s\n", n.Name)
+		} else {
+			log.Printf("Negotiator %s failed, trying the next one\n%s\n", n.Name, err)
+		}
+	}
+	h.Pool.Save()
+	return nil, err
+}
+
+// ClientIP returns the public ip of clients that talk to the negotiator
+// through a proxy, so the server punches to their own address instead of the
+// proxy's.
+func (h *HTTPSignaling) ClientIP(serverIP string) (string, error) {
+	if negotiationProxy == nil {
+		return "", nil
+	}
+	return h.PublicIPs.Get(udpNetwork(serverIP))
+}
+
+func (h *HTTPSignaling) post(c *NegotiatorConfig, serverIP string, body []byte) ([]byte, error) {
+	req, err := c.NewRequest(http.MethodPost, serverIP, body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Client(serverIP).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("POST %s failed with status %d", req.URL, res.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, 1024))
+}
+
+// DNSSignaling sends messages as TXT queries for <message>.<serverIP>.<domain>
+// to a negotiator that is authoritative for domain. The message and the ip
+// are base32 encoded, the message split into labels. The negotiator only sees
+// the recursive resolver, so the client's public ip is learned with STUN and
+// sealed into the message. Answers are the base64 encoded response or
+// "error <status>".
+type DNSSignaling struct {
+	Domain    string
+	PublicIPs PublicIPs
+}
+
+var dnsMessageEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// maxDNSNameLength is the longest name dns allows, without the root's dot.
+const maxDNSNameLength = 253
+
+func (d *DNSSignaling) ClientIP(serverIP string) (string, error) {
+	return d.PublicIPs.Get(udpNetwork(serverIP))
+}
+
+func (d *DNSSignaling) Exchange(serverIP string, message []byte) ([]byte, error) {
+	name, err := EncodeDNSMessage(message, serverIP, d.Domain)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	records, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("empty answer for %s", name)
+	}
+	answer := records[0]
+	if strings.HasPrefix(answer, "error ") {
+		return nil, fmt.Errorf("dns negotiation with %s failed with status %s", serverIP, strings.TrimPrefix(answer, "error "))
+	}
+	return base64.StdEncoding.DecodeString(answer)
+}
+
+// EncodeDNSMessage returns the name DNSSignaling queries for message, or an
+// error if it is longer than dns allows.
+func EncodeDNSMessage(message []byte, serverIP, domain string) (string, error) {
+	encoded := strings.ToLower(dnsMessageEncoding.EncodeToString(message))
+	var labels []string
+	for len(encoded) > 63 {
+		labels, encoded = append(labels, encoded[:63]), encoded[63:]
+	}
+	labels = append(labels, encoded, encodeDNSIP(serverIP), domain)
+	name := strings.Join(labels, ".")
+	if len(name) > maxDNSNameLength {
+		return "", fmt.Errorf("dns name for negotiation with %s is %d characters, %d more than dns allows, signalingDomain has to be shorter", serverIP, len(name), len(name)-maxDNSNameLength)
+	}
+	return name, nil
+}
+
+// DecodeDNSMessage reverses the encoding of DNSSignaling, returning the
+// message and server ip in name, which has the domain removed.
+func DecodeDNSMessage(name string) ([]byte, net.IP, error) {
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return nil, nil, errors.New("too few labels")
+	}
+	serverIP, err := decodeDNSIP(labels[len(labels)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	message, err := dnsMessageEncoding.DecodeString(strings.ToUpper(strings.Join(labels[:len(labels)-1], "")))
+	if err != nil {
+		return nil, nil, err
+	}
+	return message, serverIP, nil
+}
+
+func encodeDNSIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if ip4 := parsed.To4(); ip4 != nil {
+		parsed = ip4
+	}
+	return strings.ToLower(dnsMessageEncoding.EncodeToString(parsed))
+}
+
+func decodeDNSIP(s string) (net.IP, error) {
+	b, err := dnsMessageEncoding.DecodeString(strings.ToUpper(s))
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return nil, errors.New("invalid ip")
+	}
+	return net.IP(b), nil
+}
+
+// PublicIPs remembers the client's public ip per network, as learned with
+// STUN, for as long as the client reaches the STUN server from the same local
+// ip. After the client moved to another network, for example from wifi to
+// cellular, it is learned again.
+type PublicIPs struct {
+	ips map[string]publicIP
+	mu  sync.Mutex
+}
+
+type publicIP struct {
+	ip    string
+	local string
+}
+
+func (p *PublicIPs) Get(network string) (string, error) {
+	local := localIP(network, stunServerAddress())
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cached, ok := p.ips[network]; ok && local != "" && cached.local == local {
+		return cached.ip, nil
+	}
+	ip, err := discoverPublicIP(network)
+	if err != nil {
+		return "", err
+	}
+	if p.ips == nil {
+		p.ips = make(map[string]publicIP)
+	}
+	p.ips[network] = publicIP{ip: ip.String(), local: local}
+	return ip.String(), nil
+}
+
+// localIP returns the ip the system sends packets to address from, or "" if
+// it has no route there. Nothing is sent.
+func localIP(network, address string) string {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return getIPFromAddress(conn.LocalAddr().String())
+}
+
+func stunServerAddress() string {
+	if config.STUNServer == "" {
+		return "stun.l.google.com:19302"
+	}
+	return config.STUNServer
+}
+
+// discoverPublicIP sends a STUN (rfc 5389) binding request and returns the
+// address from the XOR-MAPPED-ADDRESS attribute of the response.
+func discoverPublicIP(network string) (net.IP, error) {
+	stunServer := stunServerAddress()
+	conn, err := net.DialTimeout(network, stunServer, time.Second*5)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	magicCookie := []byte{0x21, 0x12, 0xa4, 0x42}
+	transactionID := make([]byte, 12)
+	rand.Read(transactionID)
+	request := append([]byte{0, 1, 0, 0}, magicCookie...)
+	request = append(request, transactionID...)
+
+	buffer := make([]byte, 1024)
+	for attempt := 0; attempt < 3; attempt++ {
+		conn.Write(request)
+		conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			continue
+		}
+		if n < 20 || string(buffer[8:20]) != string(transactionID) {
+			continue
+		}
+		attributes := buffer[20:n]
+		for len(attributes) >= 4 {
+			attributeType := int(attributes[0])<<8 | int(attributes[1])
+			length := int(attributes[2])<<8 | int(attributes[3])
+			if len(attributes) < 4+length {
+				break
+			}
+			value := attributes[4 : 4+length]
+			if attributeType == 0x0020 && length >= 8 {
+				ip := make(net.IP, length-4)
+				for i := range ip {
+					if i < 4 {
+						ip[i] = value[4+i] ^ magicCookie[i]
+					} else {
+						ip[i] = value[4+i] ^ transactionID[i-4]
+					}
+				}
+				return ip, nil
+			}
+			next := 4 + (length+3)/4*4
+			if next > len(attributes) {
+				break
+			}
+			attributes = attributes[next:]
+		}
+		return nil, errors.New("no mapped address in STUN response")
+	}
+	return nil, fmt.Errorf("no STUN response from %s", stunServer)
+}
+
+// FileSignaling exchanges negotiation messages through a directory shared
+// with a server on the same machine, which is handy for tests. Requests are
+// written as <name>.request and answered with <name>.response.
+type FileSignaling struct {
+	Directory string
+}
+
+type FileSignalingRequest struct {
+	ServerIP string `json:"serverIP"`
+	ClientIP string `json:"clientIP"`
+	Message  []byte `json:"message"`
+}
+
+type FileSignalingResponse struct {
+	Status  int    `json:"status"`
+	Message []byte `json:"message"`
+}
+
+func (f *FileSignaling) ClientIP(serverIP string) (string, error) {
+	return "", nil
+}
+
+func (f *FileSignaling) Exchange(serverIP string, message []byte) ([]byte, error) {
+	// the client's address is the local address used to reach the server
+	conn, err := net.Dial(udpNetwork(serverIP), net.JoinHostPort(serverIP, "9"))
+	if err != nil {
+		return nil, err
+	}
+	clientIP := getIPFromAddress(conn.LocalAddr().String())
+	conn.Close()
+
+	data, err := json.Marshal(FileSignalingRequest{ServerIP: serverIP, ClientIP: clientIP, Message: message})
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Join(f.Directory, hex.EncodeToString(randomBytes(8)))
+	if err = os.WriteFile(name+".tmp", data, 0644); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(name+".tmp", name+".request"); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		data, err = os.ReadFile(name + ".response")
+		if err != nil {
+			time.Sleep(time.Millisecond * 50)
+			continue
+		}
+		os.Remove(name + ".response")
+		var response FileSignalingResponse
+		if err = json.Unmarshal(data, &response); err != nil {
+			return nil, err
+		}
+		if response.Status != 200 {
+			return nil, fmt.Errorf("file negotiation %s failed with status %d", name, response.Status)
+		}
+		return response.Message, nil
+	}
+	os.Remove(name + ".request")
+	return nil, fmt.Errorf("file negotiation %s timed out", name)
+}
+
+// WatchSignalingDirectory answers requests written by FileSignaling clients.
+func (s *Server) WatchSignalingDirectory() {
+	for {
+		time.Sleep(time.Millisecond * 50)
+		names, err := filepath.Glob(filepath.Join(config.SignalingDirectory, "*.request"))
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			data, err := os.ReadFile(name)
+			os.Remove(name)
+			if err != nil {
+				continue
+			}
+			var request FileSignalingRequest
+			response := FileSignalingResponse{Status: 400}
+			if json.Unmarshal(data, &request) == nil && net.ParseIP(request.ClientIP) != nil {
+				_, response.Message, err = s.HandleNegotiationMessage(request.ClientIP, request.Message, "")
+				if err == nil {
+					response.Status = 200
+				}
+			}
+			data, _ = json.Marshal(response)
+			responseName := strings.TrimSuffix(name, ".request") + ".response"
+			os.WriteFile(responseName+".tmp", data, 0644)
+			os.Rename(responseName+".tmp", responseName)
+		}
+	}
+}
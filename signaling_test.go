@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSTUNServer answers binding requests with the address in mapped.
+type testSTUNServer struct {
+	conn   *net.UDPConn
+	mapped net.IP
+	mu     sync.Mutex
+}
+
+func listenTestSTUN(t *testing.T, mapped net.IP) *testSTUNServer {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s := &testSTUNServer{conn: conn, mapped: mapped}
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			if n < 20 {
+				continue
+			}
+			s.mu.Lock()
+			ip := s.mapped.To4()
+			s.mu.Unlock()
+			response := append([]byte{1, 1, 0, 12}, buffer[4:20]...)
+			response = append(response, 0, 0x20, 0, 8, 0, 1, byte(from.Port>>8)^0x21, byte(from.Port)^0x12)
+			for i := range ip {
+				response = append(response, ip[i]^buffer[4+i])
+			}
+			conn.WriteToUDP(response, from)
+		}
+	}()
+	return s
+}
+
+func (s *testSTUNServer) SetMapped(ip net.IP) {
+	s.mu.Lock()
+	s.mapped = ip
+	s.mu.Unlock()
+}
+
+func TestPublicIPs(t *testing.T) {
+	stun := listenTestSTUN(t, net.IPv4(198, 51, 100, 1))
+	config.STUNServer = stun.conn.LocalAddr().String()
+	defer func() { config.STUNServer = "" }()
+
+	var p PublicIPs
+	if ip, err := p.Get("udp4"); err != nil || ip != "198.51.100.1" {
+		t.Fatalf("Get = %s, %v", ip, err)
+	}
+	stun.SetMapped(net.IPv4(198, 51, 100, 2))
+	if ip, err := p.Get("udp4"); err != nil || ip != "198.51.100.1" {
+		t.Errorf("Get on the same network = %s, %v, want the remembered ip", ip, err)
+	}
+
+	// the client was on another network when it learned the ip
+	p.mu.Lock()
+	p.ips["udp4"] = publicIP{ip: "198.51.100.1", local: "192.0.2.1"}
+	p.mu.Unlock()
+	if ip, err := p.Get("udp4"); err != nil || ip != "198.51.100.2" {
+		t.Errorf("Get after a network change = %s, %v, want the new ip", ip, err)
+	}
+}
+
+func TestDNSSignaling(t *testing.T) {
+	defer func(c Config, r *net.Resolver) { config, resolver = c, r }(config, resolver)
+	s := newTestControlServer(t)
+	control := httptest.NewServer(http.HandlerFunc(s.ServeControl))
+	defer control.Close()
+	config.ServerControl = &ControlConfig{Port: portNumber(getPortFromAddress(control.Listener.Addr().String()))}
+	config.Servers = []string{"127.0.0.1"}
+	config.SignalingDomain = "t.example.com"
+	n := &Negotiator{Client: &http.Client{Timeout: time.Second * 5}}
+	resolver = testResolver(&ResolverConfig{URL: listenTestDNS(t, func(query []byte) []byte {
+		return n.ServeDNS(query, "203.0.113.1")
+	})})
+	d := &DNSSignaling{Domain: config.SignalingDomain}
+
+	request := testNegotiationRequest(negotiateAllocate, net.IPv4(127, 0, 0, 1))
+	message, aead, err := SealNegotiationRequest(request, s.PrivateKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := d.Exchange("127.0.0.1", message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.HandleNegotiation("127.0.0.1:40000", &NegotiationRequest{Version: negotiationVersion, Method: negotiateTearDown, Token: request.Token})
+	response, err := OpenNegotiationResponse(sealed, aead)
+	if err != nil || response.Status != 200 || response.ServerPort == 0 {
+		t.Fatalf("allocate over dns answered with %+v, %v", response, err)
+	}
+
+	// a server the negotiator does not relay to
+	message, _, _ = SealNegotiationRequest(testNegotiationRequest(negotiateAllocate, nil), s.PrivateKey.PublicKey())
+	if _, err := d.Exchange("127.0.0.2", message); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("exchange with a server that is not allowed returned %v, want status 403", err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 (rfc 1928) front end of the client. CONNECT requests become streams
+// and UDP ASSOCIATE requests become udp flows, both carrying the requested
+// destination to the server.
+const (
+	socksVersion        = 5
+	socksCommandConnect = 1
+	socksCommandUDP     = 3
+	socksReplySucceeded = 0
+	socksReplyFailure   = 1
+	socksReplyCommand   = 7
+	socksReplyAddress   = 8
+	socksHandshakeTime  = time.Second * 10
+)
+
+func (c *Client) ListenForSOCKS() {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Println("panic occurred:", e)
+		}
+	}()
+	listener, err := net.Listen("tcp", config.SOCKSListenAddress)
+	if err != nil {
+		log.Panicln(err)
+	}
+	log.Printf("Listening on %s for socks connections\n", listener.Addr().String())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Panicln(err)
+		}
+		go c.HandleSOCKSConnection(conn.(*net.TCPConn))
+	}
+}
+
+func (c *Client) HandleSOCKSConnection(conn *net.TCPConn) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTime))
+
+	// method selection, only "no authentication required" is supported
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != socksVersion {
+		conn.Close()
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		conn.Close()
+		return
+	}
+	if bytes.IndexByte(methods, 0) == -1 {
+		conn.Write([]byte{socksVersion, 0xff})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{socksVersion, 0})
+
+	// request
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn, request); err != nil || request[0] != socksVersion {
+		conn.Close()
+		return
+	}
+	destination, err := readSOCKSAddress(conn)
+	if err != nil {
+		writeSOCKSReply(conn, socksReplyAddress, nil)
+		conn.Close()
+		return
+	}
+	if !c.Ready {
+		log.Printf("Tunnel is not ready, dropping socks request from %s\n", conn.RemoteAddr().String())
+		writeSOCKSReply(conn, socksReplyFailure, nil)
+		conn.Close()
+		return
+	}
+
+	switch request[1] {
+	case socksCommandConnect:
+		announcement, err := EncodeDestination(destination)
+		if err != nil {
+			writeSOCKSReply(conn, socksReplyAddress, nil)
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		// the reply waits until the server has dialed the destination, whose
+		// failures are reported with the matching socks reply
+		id, err := c.OpenStream(conn, announcement, func(reason byte) {
+			writeSOCKSReply(conn, reason, nil)
+		})
+		if err != nil {
+			log.Printf("Dropping socks connection from %s\n%s\n", conn.RemoteAddr().String(), err)
+			if err == errNoFreeID {
+				writeSOCKSReply(conn, socksReplyFailure, nil)
+			}
+			conn.Close()
+			return
+		}
+		log.Printf("Accepted socks connection from %s to %s with id of %d\n", conn.RemoteAddr().String(), destination, id)
+	case socksCommandUDP:
+		c.RelaySOCKSUDP(conn)
+	default:
+		writeSOCKSReply(conn, socksReplyCommand, nil)
+		conn.Close()
+	}
+}
+
+// RelaySOCKSUDP serves an UDP ASSOCIATE request. Each destination a client
+// sends datagrams to gets its own udp flow, which lives as long as the
+// association's tcp connection.
+func (c *Client) RelaySOCKSUDP(conn *net.TCPConn) {
+	defer conn.Close()
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Printf("Failed to open socks udp relay\n%s\n", err)
+		writeSOCKSReply(conn, socksReplyFailure, nil)
+		return
+	}
+	defer relay.Close()
+	writeSOCKSReply(conn, socksReplySucceeded, relay.LocalAddr().(*net.UDPAddr))
+	conn.SetDeadline(time.Time{})
+	log.Printf("Opened socks udp relay on %s for %s\n", relay.LocalAddr().String(), conn.RemoteAddr().String())
+
+	go func() {
+		// the association ends when its tcp connection is closed
+		io.Copy(io.Discard, conn)
+		relay.Close()
+	}()
+
+	keys := make(map[string]bool)
+	defer func() {
+		for key := range keys {
+			c.FreeUDPFlow(key)
+		}
+	}()
+
+	packet := createPacket()
+	buffer := make([]byte, (1024*8)-2)
+	for {
+		n, remoteAddress, err := relay.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if !remoteAddress.IP.Equal(clientIP) || n < 4 || buffer[0] != 0 || buffer[1] != 0 || buffer[2] != 0 {
+			continue // fragmented datagrams are not supported
+		}
+		reader := bytes.NewReader(buffer[3:n])
+		destination, err := readSOCKSAddress(reader)
+		if err != nil {
+			continue
+		}
+		announcement, err := EncodeDestination(destination)
+		if err != nil {
+			continue
+		}
+		headerLength := n - reader.Len()
+		key := fmt.Sprintf("%s>%s", remoteAddress.String(), destination)
+		id, ok := c.AssignUDPFlow(key, relay, remoteAddress, announcement, buffer[:headerLength])
+		if !ok {
+			continue
+		}
+		packet.ID = id
+		keys[key] = true
+		packet.Payload = buffer[headerLength:n]
+		if err = c.Send(packet.EncodePacket()); err != nil {
+			log.Printf("Error writing socks udp packet to server\n%s\n", err)
+		}
+	}
+}
+
+// readSOCKSAddress reads an address type, address and port and returns them
+// as host:port.
+func readSOCKSAddress(r io.Reader) (string, error) {
+	addressType := make([]byte, 1)
+	if _, err := io.ReadFull(r, addressType); err != nil {
+		return "", err
+	}
+	var host string
+	switch addressType[0] {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if addressType[0] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unknown socks address type %d", addressType[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+func writeSOCKSReply(conn net.Conn, reply byte, bound *net.UDPAddr) {
+	b := []byte{socksVersion, reply, 0}
+	if bound == nil {
+		b = append(b, 1, 0, 0, 0, 0, 0, 0)
+	} else {
+		if ip4 := bound.IP.To4(); ip4 != nil {
+			b = append(append(b, 1), ip4...)
+		} else {
+			b = append(append(b, 4), bound.IP.To16()...)
+		}
+		b = append(b, byte(bound.Port>>8), byte(bound.Port))
+	}
+	conn.Write(b)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestProxyClient returns a ready client whose streams are connected by
+// a server that dials them.
+func newTestProxyClient(t *testing.T) *Client {
+	t.Helper()
+	streams, _ := newTestStreamTables(t, 0)
+	return &Client{Ready: true, Streams: streams}
+}
+
+// refusedTestDestination returns an address nothing listens on.
+func refusedTestDestination(t *testing.T) string {
+	t.Helper()
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	return listener.Addr().String()
+}
+
+// socksTestRequest sends a socks request for command and address on app and
+// returns the reply code.
+func socksTestRequest(t *testing.T, app net.Conn, command byte, address string) byte {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(address)
+	p, _ := strconv.Atoi(port)
+	app.Write([]byte{socksVersion, 1, 0})
+	request := []byte{socksVersion, command, 0, 1}
+	request = append(request, net.ParseIP(host).To4()...)
+	request = append(request, byte(p>>8), byte(p))
+	app.Write(request)
+
+	app.SetReadDeadline(time.Now().Add(time.Second * 5))
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(app, reply); err != nil {
+		t.Fatalf("reading the socks reply failed: %s", err)
+	}
+	if !bytes.Equal(reply[:2], []byte{socksVersion, 0}) {
+		t.Fatalf("method selection answered with %v", reply[:2])
+	}
+	return reply[3]
+}
+
+func TestSOCKSConnect(t *testing.T) {
+	c := newTestProxyClient(t)
+	destination := listenTestTCP(t, echoTestTCP)
+	address, _ := DecodeDestination(destination)
+	app, local := tcpTestPair(t)
+	go c.HandleSOCKSConnection(local)
+
+	if reply := socksTestRequest(t, app, socksCommandConnect, address); reply != socksReplySucceeded {
+		t.Fatalf("connect answered with %d", reply)
+	}
+	app.Write([]byte("hello"))
+	echo := make([]byte, 5)
+	if _, err := io.ReadFull(app, echo); err != nil || string(echo) != "hello" {
+		t.Errorf("read %q, %v, want the echo", echo, err)
+	}
+}
+
+func TestSOCKSErrors(t *testing.T) {
+	c := newTestProxyClient(t)
+	tests := []struct {
+		name    string
+		command byte
+		address string
+		reply   byte
+	}{
+		{"refused", socksCommandConnect, refusedTestDestination(t), streamResetRefused},
+		{"bind", 2, "127.0.0.1:80", socksReplyCommand},
+	}
+	for _, test := range tests {
+		app, local := tcpTestPair(t)
+		go c.HandleSOCKSConnection(local)
+		if reply := socksTestRequest(t, app, test.command, test.address); reply != test.reply {
+			t.Errorf("%s: answered with %d, want %d", test.name, reply, test.reply)
+		}
+	}
+}
+
+func TestSOCKSWithoutSupportedMethod(t *testing.T) {
+	c := newTestProxyClient(t)
+	app, local := tcpTestPair(t)
+	go c.HandleSOCKSConnection(local)
+	// username and password only
+	app.Write([]byte{socksVersion, 1, 2})
+	app.SetReadDeadline(time.Now().Add(time.Second * 5))
+	reply, _ := io.ReadAll(app)
+	if !bytes.Equal(reply, []byte{socksVersion, 0xff}) {
+		t.Errorf("method selection answered with %v, want no acceptable methods", reply)
+	}
+}
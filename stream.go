@@ -0,0 +1,574 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reliable, ordered and flow-controlled byte streams carried over the udp
+// tunnel. Every stream is identified by a packet id, just like udp services.
+//
+// Sequenced segments (open, data and fin) carry a 4 byte sequence number in
+// front of their payload and are retransmitted until acknowledged. Acks carry
+// the next expected sequence number and the number of segments the receiver
+// is still willing to buffer. The sender additionally keeps an AIMD
+// congestion window so a full receive window is not burst into the link.
+//
+// The side that connects a stream to its destination answers the open with
+// an empty open segment, or resets the stream with the reason the dial
+// failed.
+const (
+	streamSegmentSize          = 1200
+	streamWindow               = 256
+	streamInitialCongestion    = 16
+	streamMinCongestion        = 4
+	streamMinRTO               = time.Millisecond * 100
+	streamMaxRTO               = time.Second * 5
+	streamMaxRetransmissions   = 20
+	streamRetransmitInterval   = time.Millisecond * 20
+	streamLinger               = time.Second * 5
+	streamDialTimeout          = time.Second * 10
+	streamFastRetransmitAckDup = 3
+)
+
+// Reasons a stream is reset with, the same values as socks replies.
+const (
+	streamOpened                  = 0
+	streamResetFailure            = 1
+	streamResetNetworkUnreachable = 3
+	streamResetHostUnreachable    = 4
+	streamResetRefused            = 5
+	streamResetTimedOut           = 6
+)
+
+var (
+	errStreamClosed = errors.New("stream closed")
+	errStreamInUse  = errors.New("stream id in use")
+)
+
+// dialErrorReason returns the reason to reset a stream with when dialing its
+// destination failed with err.
+func dialErrorReason(err error) byte {
+	var dnsError *net.DNSError
+	var netError net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return streamResetRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return streamResetNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsError):
+		return streamResetHostUnreachable
+	case errors.As(err, &netError) && netError.Timeout():
+		return streamResetTimedOut
+	}
+	return streamResetFailure
+}
+
+func isStreamFlag(flags byte) bool {
+	return flags >= 7 && flags <= 11
+}
+
+type streamSegment struct {
+	Flags         byte
+	Seq           uint32
+	Payload       []byte
+	SentAt        time.Time
+	RTO           time.Duration
+	Transmissions int
+}
+
+func (seg *streamSegment) Encode(id byte) []byte {
+	b := []byte{seg.Flags, id}
+	b = append(b, Uint32ToByteSlice(seg.Seq)...)
+	return append(b, seg.Payload...)
+}
+
+type Stream struct {
+	ID    byte
+	Conn  net.Conn
+	Table *StreamTable
+
+	mu               sync.Mutex
+	windowOpened     *sync.Cond
+	sendNext         uint32
+	unacked          []*streamSegment
+	remoteWindow     uint32
+	congestion       float64
+	duplicateAcks    int
+	receiveNext      uint32
+	outOfOrder       map[uint32]*streamSegment
+	delivery         chan *streamSegment
+	advertisedWindow uint32
+	srtt             time.Duration
+	rto              time.Duration
+	finSent          bool
+	finReceived      bool
+	finished         bool
+	closed           bool
+	done             chan struct{}
+	opened           func(reason byte) // told once whether the peer connected the stream
+}
+
+func newStream(id byte, conn net.Conn, table *StreamTable) *Stream {
+	s := &Stream{
+		ID:               id,
+		Conn:             conn,
+		Table:            table,
+		remoteWindow:     streamWindow,
+		congestion:       streamInitialCongestion,
+		outOfOrder:       make(map[uint32]*streamSegment),
+		delivery:         make(chan *streamSegment, streamWindow),
+		advertisedWindow: streamWindow,
+		rto:              streamMinRTO * 3,
+		done:             make(chan struct{}),
+	}
+	s.windowOpened = sync.NewCond(&s.mu)
+	go s.deliverLoop()
+	go s.retransmitLoop()
+	return s
+}
+
+// sendSegment queues a sequenced segment and blocks while the peer's
+// receive window is full. One segment is always allowed in flight so a
+// lost window update cannot stall the stream forever.
+func (s *Stream) sendSegment(flags byte, payload []byte) error {
+	s.mu.Lock()
+	for !s.closed && uint32(len(s.unacked)) >= s.sendWindow() {
+		s.windowOpened.Wait()
+	}
+	if s.closed {
+		s.mu.Unlock()
+		return errStreamClosed
+	}
+	seg := &streamSegment{Flags: flags, Seq: s.sendNext, Payload: payload, SentAt: time.Now(), RTO: s.rto, Transmissions: 1}
+	s.sendNext++
+	s.unacked = append(s.unacked, seg)
+	if flags == 10 {
+		s.finSent = true
+	}
+	encoded := seg.Encode(s.ID)
+	s.mu.Unlock()
+	return s.Table.Send(encoded)
+}
+
+func (s *Stream) sendWindow() uint32 {
+	w := s.remoteWindow
+	if w > uint32(s.congestion) {
+		w = uint32(s.congestion)
+	}
+	if w == 0 {
+		w = 1
+	}
+	return w
+}
+
+func (s *Stream) sendAck() {
+	s.mu.Lock()
+	window := uint32(cap(s.delivery)-len(s.delivery)) - uint32(len(s.outOfOrder))
+	s.advertisedWindow = window
+	ack := []byte{9, s.ID}
+	ack = append(ack, Uint32ToByteSlice(s.receiveNext)...)
+	ack = append(ack, Uint16ToByteSlice(uint16(window))...)
+	s.mu.Unlock()
+	s.Table.Send(ack)
+}
+
+func (s *Stream) handleSegment(flags byte, payload []byte) {
+	if len(payload) < 4 {
+		return
+	}
+	seq := ByteSliceToUint32(payload)
+	s.mu.Lock()
+	free := uint32(cap(s.delivery) - len(s.delivery))
+	if !s.closed && seq >= s.receiveNext && seq < s.receiveNext+free {
+		if _, ok := s.outOfOrder[seq]; !ok {
+			body := make([]byte, len(payload)-4)
+			copy(body, payload[4:])
+			s.outOfOrder[seq] = &streamSegment{Flags: flags, Seq: seq, Payload: body}
+		}
+		for {
+			seg, ok := s.outOfOrder[s.receiveNext]
+			if !ok {
+				break
+			}
+			delete(s.outOfOrder, s.receiveNext)
+			s.receiveNext++
+			s.delivery <- seg
+		}
+	}
+	s.mu.Unlock()
+	s.sendAck()
+}
+
+func (s *Stream) handleAck(payload []byte) {
+	if len(payload) < 6 {
+		return
+	}
+	ack := ByteSliceToUint32(payload)
+	window := uint32(ByteSliceToUint16(payload[4:]))
+	now := time.Now()
+
+	s.mu.Lock()
+	s.remoteWindow = window
+	acked := 0
+	for acked < len(s.unacked) && s.unacked[acked].Seq < ack {
+		seg := s.unacked[acked]
+		if seg.Transmissions == 1 {
+			s.updateRTO(now.Sub(seg.SentAt))
+		}
+		acked++
+	}
+	var fastRetransmit *streamSegment
+	if acked > 0 {
+		s.unacked = s.unacked[acked:]
+		s.duplicateAcks = 0
+		s.congestion += float64(acked) / s.congestion
+		if s.congestion > streamWindow {
+			s.congestion = streamWindow
+		}
+	} else if len(s.unacked) > 0 {
+		s.duplicateAcks++
+		if s.duplicateAcks == streamFastRetransmitAckDup {
+			fastRetransmit = s.unacked[0]
+			fastRetransmit.SentAt = now
+			fastRetransmit.Transmissions++
+			s.reduceCongestion(s.congestion / 2)
+		}
+	}
+	s.windowOpened.Broadcast()
+	var encoded []byte
+	if fastRetransmit != nil {
+		encoded = fastRetransmit.Encode(s.ID)
+	}
+	s.mu.Unlock()
+
+	if encoded != nil {
+		s.Table.Send(encoded)
+	}
+	s.maybeFinish()
+}
+
+// updateRTO must be called with s.mu held.
+func (s *Stream) updateRTO(rtt time.Duration) {
+	if s.srtt == 0 {
+		s.srtt = rtt
+	} else {
+		s.srtt = (s.srtt*7 + rtt) / 8
+	}
+	s.rto = s.srtt * 2
+	if s.rto < streamMinRTO {
+		s.rto = streamMinRTO
+	} else if s.rto > streamMaxRTO {
+		s.rto = streamMaxRTO
+	}
+}
+
+// reduceCongestion must be called with s.mu held.
+func (s *Stream) reduceCongestion(congestion float64) {
+	if congestion < streamMinCongestion {
+		congestion = streamMinCongestion
+	}
+	if congestion < s.congestion {
+		s.congestion = congestion
+	}
+}
+
+func (s *Stream) retransmitLoop() {
+	ticker := time.NewTicker(streamRetransmitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			var segments [][]byte
+			reset := false
+			s.mu.Lock()
+			for _, seg := range s.unacked {
+				if now.Sub(seg.SentAt) < seg.RTO {
+					continue
+				}
+				if seg.Transmissions > streamMaxRetransmissions {
+					reset = true
+					break
+				}
+				seg.Transmissions++
+				seg.SentAt = now
+				seg.RTO *= 2
+				if seg.RTO > streamMaxRTO {
+					seg.RTO = streamMaxRTO
+				}
+				segments = append(segments, seg.Encode(s.ID))
+			}
+			if len(segments) > 0 {
+				s.reduceCongestion(streamMinCongestion)
+			}
+			s.mu.Unlock()
+			if reset {
+				log.Printf("Stream with id %d timed out, resetting\n", s.ID)
+				s.Reset()
+				return
+			}
+			for _, b := range segments {
+				s.Table.Send(b)
+			}
+		}
+	}
+}
+
+func (s *Stream) deliverLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case seg := <-s.delivery:
+			switch seg.Flags {
+			case 7: // open, or the answer to ours
+				if s.Conn != nil {
+					s.notifyOpened(streamOpened)
+					break
+				}
+				if s.Table.Dial == nil {
+					break
+				}
+				conn, err := s.Table.Dial(seg.Payload)
+				if err != nil {
+					log.Printf("Failed to open stream with id %d\n%s\n", s.ID, err)
+					s.ResetWithReason(dialErrorReason(err))
+					return
+				}
+				s.mu.Lock()
+				s.Conn = conn
+				s.mu.Unlock()
+				log.Printf("Created new stream to %s for packets with id %d\n", conn.RemoteAddr().String(), s.ID)
+				if s.sendSegment(7, nil) != nil {
+					return
+				}
+				go s.readLoop()
+			case 8: // data
+				if s.Conn == nil {
+					s.Reset()
+					return
+				}
+				if _, err := s.Conn.Write(seg.Payload); err != nil {
+					if !s.isClosed() {
+						log.Printf("Error writing to stream with id %d\n%s\n", s.ID, err)
+						s.Reset()
+					}
+					return
+				}
+			case 10: // fin
+				if cw, ok := s.Conn.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+				s.mu.Lock()
+				s.finReceived = true
+				s.mu.Unlock()
+				s.maybeFinish()
+			}
+
+			s.mu.Lock()
+			reopened := s.advertisedWindow < streamWindow/2 && len(s.delivery) == 0
+			s.mu.Unlock()
+			if reopened {
+				s.sendAck()
+			}
+		}
+	}
+}
+
+func (s *Stream) readLoop() {
+	for {
+		buffer := make([]byte, streamSegmentSize)
+		n, err := s.Conn.Read(buffer)
+		if n > 0 {
+			if s.sendSegment(8, buffer[:n]) != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			s.sendSegment(10, nil)
+			s.maybeFinish()
+			return
+		}
+		if err != nil {
+			if !s.isClosed() {
+				log.Printf("Error reading from stream with id %d\n%s\n", s.ID, err)
+				s.Reset()
+			}
+			return
+		}
+	}
+}
+
+// maybeFinish closes the stream gracefully once both directions are closed
+// and everything we sent has been acknowledged. The stream lingers in the
+// table for a while so duplicate segments from the peer are still acked.
+func (s *Stream) maybeFinish() {
+	s.mu.Lock()
+	if s.closed || s.finished || !s.finSent || !s.finReceived || len(s.unacked) > 0 {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.mu.Unlock()
+
+	if s.Conn != nil {
+		s.Conn.Close()
+	}
+	time.AfterFunc(streamLinger, func() { s.abort(false, streamResetFailure) })
+}
+
+func (s *Stream) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Reset aborts the stream and tells the peer to do the same.
+func (s *Stream) Reset() {
+	s.ResetWithReason(streamResetFailure)
+}
+
+// ResetWithReason is Reset with the reason the peer is told.
+func (s *Stream) ResetWithReason(reason byte) {
+	if s.abort(true, reason) {
+		s.Table.Send([]byte{11, s.ID, reason})
+	}
+}
+
+// notifyOpened tells the opener of the stream whether the peer connected it.
+func (s *Stream) notifyOpened(reason byte) {
+	s.mu.Lock()
+	opened := s.opened
+	s.opened = nil
+	s.mu.Unlock()
+	if opened != nil {
+		opened(reason)
+	}
+}
+
+// abort tears the stream down and reports whether it was still open.
+// A reset makes the local side of the tcp connection see a reset as well,
+// unless the stream was never opened and its opener has just answered its
+// own client with reason.
+func (s *Stream) abort(reset bool, reason byte) bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false
+	}
+	s.closed = true
+	close(s.done)
+	s.windowOpened.Broadcast()
+	conn := s.Conn
+	opened := s.opened
+	s.opened = nil
+	s.mu.Unlock()
+
+	if opened != nil {
+		opened(reason)
+		reset = false
+	}
+	if conn != nil {
+		if lingerer, ok := conn.(interface{ SetLinger(int) error }); ok && reset {
+			lingerer.SetLinger(0)
+		}
+		conn.Close()
+	}
+	s.Table.remove(s)
+	return true
+}
+
+type StreamTable struct {
+	Streams map[byte]*Stream
+	Send    func([]byte) error
+	Dial    func(destination []byte) (net.Conn, error) // nil if the peer is not allowed to open streams
+	mu      sync.Mutex
+}
+
+func newStreamTable(send func([]byte) error, dial func([]byte) (net.Conn, error)) *StreamTable {
+	return &StreamTable{Streams: make(map[byte]*Stream), Send: send, Dial: dial}
+}
+
+func (t *StreamTable) Has(id byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.Streams[id]
+	return ok
+}
+
+// Open starts a new stream for a local connection and asks the peer to
+// connect it to destination. If opened is not nil it is called with the
+// outcome before anything from the peer is written to conn. It fails if id
+// is already in use.
+func (t *StreamTable) Open(id byte, conn net.Conn, destination []byte, opened func(reason byte)) error {
+	t.mu.Lock()
+	if _, ok := t.Streams[id]; ok {
+		t.mu.Unlock()
+		return errStreamInUse
+	}
+	s := newStream(id, conn, t)
+	s.opened = opened
+	t.Streams[id] = s
+	t.mu.Unlock()
+	if err := s.sendSegment(7, destination); err != nil {
+		s.Reset()
+		return err
+	}
+	go s.readLoop()
+	return nil
+}
+
+func (t *StreamTable) HandlePacket(packet *Packet) {
+	t.mu.Lock()
+	s, ok := t.Streams[packet.ID]
+	if !ok && packet.Flags == 7 && t.Dial != nil {
+		s = newStream(packet.ID, nil, t)
+		t.Streams[packet.ID] = s
+	}
+	t.mu.Unlock()
+	if s == nil {
+		return
+	}
+
+	switch packet.Flags {
+	case 7, 8, 10:
+		s.handleSegment(packet.Flags, packet.Payload)
+	case 9:
+		s.handleAck(packet.Payload)
+	case 11:
+		log.Printf("Received reset for stream with id %d\n", packet.ID)
+		reason := byte(streamResetFailure)
+		if len(packet.Payload) > 0 {
+			reason = packet.Payload[0]
+		}
+		s.abort(true, reason)
+	}
+}
+
+func (t *StreamTable) remove(s *Stream) {
+	t.mu.Lock()
+	if t.Streams[s.ID] == s {
+		delete(t.Streams, s.ID)
+	}
+	t.mu.Unlock()
+}
+
+// CloseAll resets every stream in the table, used when the tunnel goes away.
+func (t *StreamTable) CloseAll() {
+	t.mu.Lock()
+	streams := make([]*Stream, 0, len(t.Streams))
+	for _, s := range t.Streams {
+		streams = append(streams, s)
+	}
+	t.mu.Unlock()
+	for _, s := range streams {
+		s.abort(true, streamResetFailure)
+	}
+}
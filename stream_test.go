@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStreamLink carries packets between two stream tables in order, like
+// the tunnel does, and loses each of them with probability loss.
+type testStreamLink struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+	loss float64
+	done chan struct{}
+}
+
+// send returns a send function for a table that delivers to the table
+// returned by to.
+func (l *testStreamLink) send(to func() *StreamTable) func([]byte) error {
+	queue := make(chan []byte, 1024)
+	go func() {
+		for {
+			select {
+			case <-l.done:
+				return
+			case b := <-queue:
+				var packet Packet
+				packet.DecodePacket(b)
+				to().HandlePacket(&packet)
+			}
+		}
+	}()
+	return func(b []byte) error {
+		l.mu.Lock()
+		lost := l.rand.Float64() < l.loss
+		l.mu.Unlock()
+		if !lost {
+			select {
+			case queue <- append([]byte{}, b...):
+			default:
+			}
+		}
+		return nil
+	}
+}
+
+// newTestStreamTables returns the stream tables of a client and a server that
+// dials tcp destinations, linked with loss.
+func newTestStreamTables(t *testing.T, loss float64) (client, server *StreamTable) {
+	t.Helper()
+	link := &testStreamLink{rand: rand.New(rand.NewSource(1)), loss: loss, done: make(chan struct{})}
+	client = newStreamTable(link.send(func() *StreamTable { return server }), nil)
+	server = newStreamTable(link.send(func() *StreamTable { return client }), func(destination []byte) (net.Conn, error) {
+		address, err := DecodeDestination(destination)
+		if err != nil {
+			return nil, err
+		}
+		return net.DialTimeout("tcp", address, time.Second)
+	})
+	t.Cleanup(func() {
+		client.CloseAll()
+		server.CloseAll()
+		close(link.done)
+	})
+	return client, server
+}
+
+// tcpTestPair returns both ends of a tcp connection on 127.0.0.1.
+func tcpTestPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan *net.TCPConn, 1)
+	go func() {
+		conn, _ := listener.AcceptTCP()
+		accepted <- conn
+	}()
+	dialed, err := net.DialTCP("tcp4", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("accepting the test connection failed")
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed, conn
+}
+
+// listenTestTCP returns the destination of a tcp listener on 127.0.0.1 that
+// serves every connection with handle.
+func listenTestTCP(t *testing.T, handle func(conn *net.TCPConn)) []byte {
+	t.Helper()
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	destination, err := EncodeDestination(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return destination
+}
+
+// echoTestTCP echoes everything and closes its side once the peer has.
+func echoTestTCP(conn *net.TCPConn) {
+	io.Copy(conn, conn)
+	conn.CloseWrite()
+}
+
+// waitForStreamRemoved fails unless the stream with id leaves table soon.
+func waitForStreamRemoved(t *testing.T, table *StreamTable, id byte) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for table.Has(id) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream %d is still in the table", id)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	for _, loss := range []float64{0, 0.05, 0.2} {
+		t.Run(fmt.Sprintf("%.0f%% loss", loss*100), func(t *testing.T) {
+			client, _ := newTestStreamTables(t, loss)
+			destination := listenTestTCP(t, echoTestTCP)
+			app, local := tcpTestPair(t)
+			opened := make(chan byte, 1)
+			if err := client.Open(1, local, destination, func(reason byte) { opened <- reason }); err != nil {
+				t.Fatal(err)
+			}
+
+			sent := make([]byte, 256*1024)
+			rand.New(rand.NewSource(2)).Read(sent)
+			go func() {
+				app.Write(sent)
+				app.CloseWrite()
+			}()
+			app.SetReadDeadline(time.Now().Add(time.Second * 30))
+			received, err := io.ReadAll(app)
+			if err != nil {
+				t.Fatalf("reading the echo failed after %d bytes: %s", len(received), err)
+			}
+			if !bytes.Equal(received, sent) {
+				t.Errorf("received %d bytes that differ from the %d sent", len(received), len(sent))
+			}
+			if reason := <-opened; reason != streamOpened {
+				t.Errorf("stream opened with reason %d", reason)
+			}
+		})
+	}
+}
+
+func TestStreamFin(t *testing.T) {
+	client, _ := newTestStreamTables(t, 0)
+	// the destination answers and closes its side without waiting for the
+	// client to close its own
+	received := make(chan []byte, 1)
+	destination := listenTestTCP(t, func(conn *net.TCPConn) {
+		conn.Write([]byte("bye"))
+		conn.CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		b, _ := io.ReadAll(conn)
+		received <- b
+		conn.Close()
+	})
+	app, local := tcpTestPair(t)
+	if err := client.Open(1, local, destination, nil); err != nil {
+		t.Fatal(err)
+	}
+	app.SetReadDeadline(time.Now().Add(time.Second * 5))
+	b, err := io.ReadAll(app)
+	if err != nil || string(b) != "bye" {
+		t.Fatalf("read %q, %v, want bye and the end of the stream", b, err)
+	}
+	// the client can still send until it closes its side as well
+	if _, err := app.Write([]byte("done")); err != nil {
+		t.Fatal(err)
+	}
+	app.CloseWrite()
+	if b := <-received; string(b) != "done" {
+		t.Errorf("destination read %q, want done and the end of the stream", b)
+	}
+}
+
+func TestStreamResetWhenDialFails(t *testing.T) {
+	client, _ := newTestStreamTables(t, 0)
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination, _ := EncodeDestination(listener.Addr().String())
+	listener.Close()
+
+	_, local := tcpTestPair(t)
+	opened := make(chan byte, 1)
+	if err := client.Open(1, local, destination, func(reason byte) { opened <- reason }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case reason := <-opened:
+		if reason != streamResetRefused {
+			t.Errorf("stream was reset with reason %d, want %d", reason, streamResetRefused)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("stream was not reset")
+	}
+	waitForStreamRemoved(t, client, 1)
+}
+
+func TestStreamResetByDestination(t *testing.T) {
+	client, _ := newTestStreamTables(t, 0)
+	// the destination aborts the connection
+	destination := listenTestTCP(t, func(conn *net.TCPConn) {
+		conn.Read(make([]byte, 1))
+		conn.SetLinger(0)
+		conn.Close()
+	})
+	app, local := tcpTestPair(t)
+	if err := client.Open(1, local, destination, nil); err != nil {
+		t.Fatal(err)
+	}
+	app.Write([]byte("x"))
+	app.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err := app.Read(make([]byte, 1))
+	var netError net.Error
+	if err == nil || err == io.EOF || (errors.As(err, &netError) && netError.Timeout()) {
+		t.Fatalf("read returned %v, want the connection to be reset", err)
+	}
+	waitForStreamRemoved(t, client, 1)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// TunConfig describes the tun interface used in layer 3 vpn mode. Raw ip
+// packets read from the interface are carried over the tunnel with flag 12.
+type TunConfig struct {
+	Name    string   `json:"name"`
+	Address string   `json:"address"`
+	MTU     int      `json:"mtu"`
+	Routes  []string `json:"routes"`
+	NAT     bool     `json:"nat"`
+}
+
+type Tun struct {
+	File    *os.File
+	Name    string
+	IP      net.IP     // the interface's own address
+	Network *net.IPNet // nil if the address is not in CIDR notation
+}
+
+// OpenTun creates the tun interface, assigns its address and installs the
+// configured routes. On the server it also enables forwarding and masquerades
+// traffic from the tunnel network if nat is set.
+func OpenTun(tunConfig *TunConfig) *Tun {
+	name := tunConfig.Name
+	if name == "" {
+		name = "sneaky0"
+	}
+	mtu := tunConfig.MTU
+	if mtu == 0 {
+		mtu = 1400
+	}
+	file, name, err := openTunDevice(name)
+	if err != nil {
+		log.Panicln(err)
+	}
+	t := &Tun{File: file, Name: name}
+	if ip, network, err := net.ParseCIDR(tunConfig.Address); err == nil {
+		t.IP, t.Network = ip, network
+	}
+
+	t.run("ip", "link", "set", "dev", name, "mtu", fmt.Sprint(mtu), "up")
+	if tunConfig.Address != "" {
+		t.run("ip", "addr", "add", tunConfig.Address, "dev", name)
+	}
+	for _, route := range tunConfig.Routes {
+		t.run("ip", "route", "replace", route, "dev", name)
+	}
+	if tunConfig.NAT {
+		if t.Network == nil {
+			log.Panicf("NAT needs the tun address in CIDR notation, not %s\n", tunConfig.Address)
+		}
+		rule := []string{"POSTROUTING", "-s", t.Network.String(), "!", "-o", name, "-j", "MASQUERADE"}
+		if t.Network.IP.To4() != nil {
+			os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)
+			t.addRule("iptables", rule...)
+		} else {
+			os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644)
+			t.addRule("ip6tables", rule...)
+		}
+	}
+	log.Printf("Opened tun interface %s with address %s\n", name, tunConfig.Address)
+	return t
+}
+
+func (t *Tun) run(name string, args ...string) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		log.Panicf("%s %s failed: %s\n%s\n", name, strings.Join(args, " "), err, output)
+	}
+}
+
+// addRule appends a nat rule unless it is already there from an earlier run.
+func (t *Tun) addRule(command string, rule ...string) {
+	check := append([]string{"-t", "nat", "-C"}, rule...)
+	if exec.Command(command, check...).Run() == nil {
+		return
+	}
+	t.run(command, append([]string{"-t", "nat", "-A"}, rule...)...)
+}
+
+// GetIPPacketAddresses returns the source and destination addresses of an
+// ipv4 or ipv6 packet.
+func GetIPPacketAddresses(packet []byte) (net.IP, net.IP, bool) {
+	if len(packet) < 1 {
+		return nil, nil, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return nil, nil, false
+		}
+		return net.IP(packet[12:16]), net.IP(packet[16:20]), true
+	case 6:
+		if len(packet) < 40 {
+			return nil, nil, false
+		}
+		return net.IP(packet[8:24]), net.IP(packet[24:40]), true
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tunSetIff = 0x400454ca
+	iffTun    = 0x0001
+	iffNoPi   = 0x1000
+)
+
+func openTunDevice(name string) (*os.File, string, error) {
+	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	var ifr [40]byte
+	copy(ifr[:syscall.IFNAMSIZ-1], name)
+	*(*uint16)(unsafe.Pointer(&ifr[syscall.IFNAMSIZ])) = iffTun | iffNoPi
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), tunSetIff, uintptr(unsafe.Pointer(&ifr[0])))
+	if errno != 0 {
+		file.Close()
+		return nil, "", errno
+	}
+	end := 0
+	for end < syscall.IFNAMSIZ && ifr[end] != 0 {
+		end++
+	}
+	return file, string(ifr[:end]), nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func openTunDevice(name string) (*os.File, string, error) {
+	return nil, "", errors.New("tun mode is only supported on linux")
+}